@@ -0,0 +1,791 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/andfasano/metal-ipi-releases/internal/flakes"
+	"github.com/andfasano/metal-ipi-releases/internal/gcs"
+	"github.com/andfasano/metal-ipi-releases/internal/prow"
+	"github.com/andfasano/metal-ipi-releases/internal/release"
+)
+
+const (
+	// The GitHub repository where the tool is released
+	releasesRepo = "andfasano/metal-ipi-releases"
+)
+
+// The build details, set when building a release with
+// -ldflags "-X main.buildVersion=v1.2.0 -X main.buildCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	buildVersion = "dev"
+	buildCommit  = "unknown"
+	buildDate    = "unknown"
+)
+
+// listFlag is a comma separated list of values
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = listFlag{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// setupLogging logs the messages at least as severe as level to stderr, so
+// that they never mix with the reports
+func setupLogging(level slog.Level) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+}
+
+// fatal logs the error message with its attributes and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// githubRelease is a release of a GitHub repository
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Url     string `json:"html_url"`
+}
+
+// printVersion shows the build details and, if gh is set, tells if
+// a newer release is available on GitHub
+func printVersion(ctx context.Context, gh *flakes.Github) error {
+	fmt.Printf("%s %s (commit %s, built %s)\n", filepath.Base(os.Args[0]), buildVersion, buildCommit, buildDate)
+	if gh == nil {
+		return nil
+	}
+
+	latest := githubRelease{}
+	if err := gh.Api(ctx, http.MethodGet, fmt.Sprintf("/repos/%s/releases/latest", releasesRepo), nil, &latest); err != nil {
+		return err
+	}
+	switch {
+	case buildVersion == "dev":
+		fmt.Printf("Development build, the latest release is %s: %s\n", latest.TagName, latest.Url)
+	case latest.TagName != buildVersion:
+		fmt.Printf("A newer release %s is available: %s\n", latest.TagName, latest.Url)
+	default:
+		fmt.Println("Up to date")
+	}
+	return nil
+}
+
+// command holds the options of the command line tool other than the
+// analysis ones, and the external services the jobs are looked up in
+type command struct {
+	opts *flakes.Options
+	// The release stream whose jobs are analyzed, and its versions
+	rs       release.Stream
+	versions []string
+	// The reports format, either text, json, csv, html, markdown or prometheus
+	output string
+	// If set, every analyzed build is listed with its outcome
+	showBuilds bool
+	// If set, the flakiness of every test is compared across the
+	// analyzed versions of the same job
+	compareAcrossVersions bool
+	// If set, the metrics are pushed to this Prometheus Pushgateway
+	pushgatewayUrl string
+
+	controller *release.ReleaseController
+	slack      *flakes.Slack
+	// Only the configured services are looked up
+	sippy     *release.Sippy
+	github    *flakes.Github
+	jira      *flakes.Jira
+	issueTmpl *texttemplate.Template
+}
+
+// enrichJob looks up the flaky tests of the job in the configured
+// external services
+func (c *command) enrichJob(ctx context.Context, job *flakes.Job) {
+	if c.sippy != nil {
+		job.FetchSippy(ctx, c.sippy)
+	}
+	if c.github != nil {
+		job.CorrelateIssues(ctx, c.github, c.issueTmpl)
+	}
+	if c.jira != nil {
+		job.LookupBugs(ctx, c.jira)
+	}
+}
+
+// runAnalysis analyzes the jobs, printing their reports and notifying
+// the configured services
+func (c *command) runAnalysis(ctx context.Context, jobNames []string, notified map[string]string) {
+	jobs := []*flakes.Job{}
+	for _, name := range jobNames {
+		job := flakes.Analyze(ctx, name, c.opts)
+		if ctx.Err() != nil {
+			break
+		}
+		if job == nil {
+			continue
+		}
+		c.enrichJob(ctx, job)
+		jobs = append(jobs, job)
+		if c.output != "text" {
+			continue
+		}
+		job.ShowIntermittentFailures()
+		if c.showBuilds {
+			job.ShowBuilds()
+		}
+		job.ShowPermafailingTests()
+		job.ShowInRunFlakes()
+		job.ShowSigSummaries()
+		job.ShowBuildDurations()
+		job.ShowStepDurations()
+		job.ShowSlowerTests()
+		job.ShowStepFailures()
+		job.ShowUpgradeEdges()
+		job.ShowInstallFailures()
+		job.ShowFailureLabels()
+		job.ShowProvisioningErrors()
+		job.ShowTeardownFailures()
+	}
+
+	if ctx.Err() != nil {
+		slog.Warn("Interrupted, the analysis in progress was not saved")
+	} else {
+		c.slack.Notify(ctx, jobs, c.controller, c.rs, notified)
+		if c.pushgatewayUrl != "" {
+			metrics := bytes.Buffer{}
+			err := flakes.WriteMetrics(ctx, &metrics, jobs, c.controller, c.rs, c.versions)
+			if err == nil {
+				err = flakes.PushMetrics(ctx, c.opts.Client.Fetcher, c.pushgatewayUrl, metrics.Bytes())
+			}
+			if err != nil {
+				slog.Error("Unable to push the metrics", "url", c.pushgatewayUrl, "err", err)
+			}
+		}
+	}
+
+	switch c.output {
+	case "json", "csv":
+		records := []flakes.FlakeRecord{}
+		for _, job := range jobs {
+			records = append(records, job.FlakeRecords()...)
+		}
+		if err := flakes.WriteFlakeRecords(os.Stdout, c.output, records); err != nil {
+			fatal("Unable to write the report", "output", c.output, "err", err)
+		}
+		return
+	case "html":
+		if err := flakes.WriteHtmlReport(os.Stdout, jobs, nil); err != nil {
+			fatal("Unable to write the report", "output", c.output, "err", err)
+		}
+		return
+	case "markdown":
+		if err := flakes.WriteMarkdownReport(os.Stdout, jobs); err != nil {
+			fatal("Unable to write the report", "output", c.output, "err", err)
+		}
+		return
+	case "prometheus":
+		if err := flakes.WriteMetrics(ctx, os.Stdout, jobs, c.controller, c.rs, c.versions); err != nil {
+			fatal("Unable to write the report", "output", c.output, "err", err)
+		}
+		return
+	}
+
+	if c.compareAcrossVersions {
+		flakes.ShowVersionsComparison(jobs)
+	}
+
+	fmt.Println("-----------------------------------------")
+	for _, job := range jobs {
+		job.ShowNotAnalyzedBuilds()
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// loadConfig reads a YAML configuration file. Only the subset needed by the
+// tool is supported, that is scalars and lists of scalars, e.g.
+//
+//	versions: ["4.9", "4.10"]
+//	num-builds: 20
+//	ignore:
+//	  - "[sig-arch] Monitor cluster while tests execute"
+//	include-tests:
+//	  - '^\[sig-network\]'
+func loadConfig(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := make(map[string][]string)
+	key := ""
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(yamlStripComment(scanner.Text()))
+		if line == "" || line == "---" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "- ") || line == "-" {
+			if key == "" {
+				return nil, fmt.Errorf("%s:%d: list item without a key", path, n)
+			}
+			value, err := yamlScalar(strings.TrimPrefix(line, "-"))
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+			config[key] = append(config[key], value)
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected a key", path, n)
+		}
+		key = strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		config[key] = []string{}
+
+		if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				if strings.TrimSpace(item) == "" {
+					continue
+				}
+				v, err := yamlScalar(item)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+				}
+				config[key] = append(config[key], v)
+			}
+		} else if value != "" {
+			v, err := yamlScalar(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+			config[key] = append(config[key], v)
+		}
+	}
+
+	return config, scanner.Err()
+}
+
+// yamlStripComment removes a trailing comment, if not within quotes
+func yamlStripComment(line string) string {
+	quote := rune(0)
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// yamlScalar unquotes a scalar value
+func yamlScalar(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.HasPrefix(value, `"`):
+		return strconv.Unquote(value)
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'"), nil
+	}
+	return value, nil
+}
+
+// applyConfig sets the options found in the configuration file, keyed by
+// their flag name, unless already set from the command line. The ignore
+// key extends the list of the tests to be ignored, by their exact name
+func applyConfig(path string, opts *flakes.Options) error {
+	config, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	for key, values := range config {
+		if key == "ignore" {
+			for _, v := range values {
+				opts.IgnoreTests = append(opts.IgnoreTests, flakes.ExactMatch(v))
+			}
+			continue
+		}
+
+		f := flag.Lookup(key)
+		if key == "config" || f == nil {
+			return fmt.Errorf("%s: unknown option %s", path, key)
+		}
+		// Patterns are added to the ones from the command line, one at a
+		// time since they could contain commas
+		if _, ok := f.Value.(*flakes.Patterns); ok {
+			for _, v := range values {
+				if err := f.Value.Set(v); err != nil {
+					return fmt.Errorf("%s: invalid value for %s: %w", path, key, err)
+				}
+			}
+			continue
+		}
+		if setFlags[key] {
+			continue
+		}
+		if err := flag.Set(key, strings.Join(values, ",")); err != nil {
+			return fmt.Errorf("%s: invalid value for %s: %w", path, key, err)
+		}
+	}
+
+	return nil
+}
+
+// loadFailureRules reads the known failure signatures from a YAML file
+func loadFailureRules(path string) ([]prow.FailureRule, error) {
+	config, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := prow.ParseFailureRules(config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+func main() {
+	// The flags may change the level, once parsed
+	setupLogging(slog.LevelInfo)
+
+	opts := flakes.DefaultOptions(gcs.DefaultCacheDir())
+	client := opts.Client
+	c := &command{
+		opts:       opts,
+		output:     "text",
+		versions:   []string{"4.10"},
+		controller: &release.ReleaseController{Url: "https://%s.ocp.releases.ci.openshift.org", Client: client},
+		slack:      &flakes.Slack{Top: 5},
+		sippy:      &release.Sippy{Url: "https://sippy.dptools.openshift.org", Client: client},
+		github:     flakes.NewGithub("https://api.github.com", nil),
+		jira:       &flakes.Jira{Url: "https://issues.redhat.com", Project: "OCPBUGS", Top: 10},
+	}
+
+	var (
+		versions        = listFlag(c.versions)
+		stream          = "nightly"
+		jobTests        = listFlag{"e2e-metal-ipi"}
+		includeVariants = false
+		jobLayouts      = listFlag{}
+		rulesFile       = ""
+		slackWebhooks   = listFlag{}
+		useSippy        = false
+		useJira         = false
+		issueTemplate   = ""
+		trendPeriod     = 24 * time.Hour
+		svgDir          = ""
+		interval        = time.Duration(0)
+		listenAddr      = ":8080"
+		refreshInterval = time.Hour
+		quiet           = false
+		verbose         = false
+		checkUpdate     = false
+		rateLimit       = 10.0
+		recordDir       = ""
+		replayDir       = ""
+	)
+
+	flag.IntVar(&client.Concurrency, "concurrency", client.Concurrency, "Number of parallel downloads")
+	flag.IntVar(&client.Retries, "retries", client.Retries, "Number of retries for a failing artifact download")
+	flag.DurationVar(&client.RetryBackoff, "retry-backoff", client.RetryBackoff, "Delay before the first retry, doubled at every further attempt")
+	flag.DurationVar(&client.CacheTTL, "cache-ttl", client.CacheTTL, "For how long downloaded files are reused before checking the server again")
+	flag.DurationVar(&opts.InstallTimeout, "install-timeout", opts.InstallTimeout, "Duration after which a failed install is considered timed out")
+	flag.BoolVar(&opts.Metal3Logs, "metal3-logs", opts.Metal3Logs, "Scan the baremetal-operator and ironic pods logs of the failed builds for provisioning errors")
+	flag.StringVar(&rulesFile, "rules", rulesFile, "YAML file with the known failure signatures, as lists of regular expressions matching the build logs keyed by label")
+	flag.DurationVar(&opts.MinSlowdown, "min-slowdown", opts.MinSlowdown, "Minimum growth of the median duration of a test to report it as slower")
+	flag.DurationVar(&opts.ProwTimeout, "prow-timeout", opts.ProwTimeout, "Duration after which a build is considered stopped by the Prow timeout")
+	flag.BoolVar(&opts.ShowDetails, "details", opts.ShowDetails, "Show the links to the builds where every test failed")
+	flag.BoolVar(&c.showBuilds, "show-builds", c.showBuilds, "List every analyzed build, with its outcome and number of failed tests")
+	flag.BoolVar(&c.compareAcrossVersions, "compare-versions", c.compareAcrossVersions, "Compare the flaky tests of every job across the analyzed versions, with the text output")
+	flag.BoolVar(&includeVariants, "include-variants", includeVariants, "Track also the techpreview and OKD variants of every job")
+	flag.BoolVar(&opts.LowMemory, "low-memory", opts.LowMemory, "Keep the tests history on disk instead of in memory, for very large scans")
+	flag.Float64Var(&rateLimit, "rate-limit", rateLimit, "Maximum number of requests per second, 0 for no limit")
+	flag.Var(&jobTests, "jobs", "Comma separated jobs to analyze, as tests names like e2e-metal-ipi-ovn-ipv6, full periodic or pull request job names, or job names templates with %s for the version")
+	flag.Var(&jobLayouts, "job-layouts", "Comma separated test step overrides, as <job regex>=<test step>[:<junit dir>], for the jobs not detected automatically")
+	flag.Var(&opts.IgnoreTests, "ignore-tests", "Regular expression matching the names of the tests not to analyze, can be repeated")
+	flag.Var(&opts.IncludeTests, "include-tests", "Regular expression matching the names of the only tests to analyze, can be repeated")
+	flag.Var(&versions, "versions", "Comma separated releases whose jobs are analyzed")
+	flag.IntVar(&opts.NumBuilds, "num-builds", opts.NumBuilds, "Number of builds analyzed for every job")
+	flag.IntVar(&opts.RetainBuilds, "retain-builds", opts.RetainBuilds, "Number of the newest analyzed builds kept in the history of every job, pruning the older ones at every run. Defaults to -num-builds, and ignored with -since and -until")
+	flag.Func("since", "Analyze all the builds finished since the given date, e.g. 2021-10-01, instead of the last ones", func(v string) (err error) {
+		opts.Since, err = time.Parse("2006-01-02", v)
+		return err
+	})
+	flag.Func("until", "Analyze all the builds finished until the given date included, e.g. 2021-10-15, instead of the last ones", func(v string) error {
+		t, err := time.Parse("2006-01-02", v)
+		opts.Until = t.AddDate(0, 0, 1)
+		return err
+	})
+	flag.Func("pulls", "Analyze only the builds of the pull requests within the given range, e.g. 5000..5100, for the pull requests jobs", func(v string) error {
+		bounds := strings.Split(v, "..")
+		if len(bounds) != 2 {
+			return fmt.Errorf("Invalid pull requests range %s, expected <from>..<to>", v)
+		}
+		var err error
+		if opts.PullsFrom, err = strconv.Atoi(bounds[0]); err != nil {
+			return err
+		}
+		if opts.PullsTo, err = strconv.Atoi(bounds[1]); err != nil {
+			return err
+		}
+		if opts.PullsFrom > opts.PullsTo {
+			return fmt.Errorf("the range start must not be after its end")
+		}
+		return nil
+	})
+	flag.StringVar(&opts.FlakeDefinition, "flake-definition", opts.FlakeDefinition, "How flaky tests are detected: flips, for the tests changing their state, or failure-rate, for the tests failing less often than -max-failure-rate")
+	flag.Float64Var(&opts.MaxFailureRate, "max-failure-rate", opts.MaxFailureRate, "Tests failing more often than that are not considered flaky, with the failure-rate definition")
+	flag.Float64Var(&opts.PermafailRate, "permafail-rate", opts.PermafailRate, "Tests failing at least that often, between 0 and 1, are reported as consistently failing rather than flaky")
+	flag.DurationVar(&trendPeriod, "trend-period", trendPeriod, "Period whose builds are grouped together by the trend command")
+	flag.StringVar(&svgDir, "svg-dir", svgDir, "Folder where the trend command saves the charts as SVG images")
+	flag.Float64Var(&opts.MinChange, "min-change", opts.MinChange, "Minimum change of the pass rate or of the flakiness of a test, between 0 and 1, reported by the compare command")
+	flag.IntVar(&opts.Top, "top", opts.Top, "Report only the given number of top flaky tests for every job, 0 for all of them")
+	flag.Float64Var(&opts.MinFlakiness, "min-flakiness", opts.MinFlakiness, "Do not report the tests flaking less often than that, between 0 and 1")
+	flag.StringVar(&c.output, "output", c.output, "Reports format: text, json, csv, html, markdown or prometheus. Only the flaky tests are reported in the formats other than text and prometheus")
+	flag.StringVar(&stream, "stream", stream, fmt.Sprintf("Release stream whose jobs are analyzed (%s)", strings.Join(release.StreamNames(), ", ")))
+	flag.StringVar(&opts.CacheDir, "cache-dir", opts.CacheDir, "Where the cached data are stored")
+	flag.BoolVar(&opts.RebuildCache, "rebuild-cache", opts.RebuildCache, "Analyze again all the builds, ignoring the saved results. The downloaded files are still reused")
+	flag.BoolVar(&client.Offline, "offline", client.Offline, "Use only the cached data, without accessing the network")
+	flag.StringVar(&recordDir, "record", recordDir, "Store every response received as a fixture in this folder")
+	flag.StringVar(&replayDir, "replay", replayDir, "Serve the responses from the fixtures recorded in this folder, without accessing the network")
+	flag.StringVar(&client.AuthToken, "token", client.AuthToken, "Bearer token for private Prow and GCS endpoints (default $AUTH_TOKEN)")
+	flag.Var(&slackWebhooks, "slack-webhooks", "Comma separated Slack incoming webhooks notified about the jobs with new builds, as <job regex>=<webhook url>")
+	flag.BoolVar(&useSippy, "sippy", useSippy, "Show the pass rates of the flaky tests in all the jobs of the release, by variant, according to Sippy")
+	flag.StringVar(&c.sippy.Url, "sippy-url", c.sippy.Url, "Sippy url")
+	flag.StringVar(&c.github.Repo, "github-repo", c.github.Repo, "GitHub repository, as org/repo, whose open issues are matched with the flaky tests")
+	flag.StringVar(&c.github.ApiUrl, "github-api-url", c.github.ApiUrl, "GitHub API url")
+	flag.StringVar(&c.github.Token, "github-token", c.github.Token, "GitHub token, required to file issues (default $GITHUB_TOKEN)")
+	flag.BoolVar(&c.github.FileIssues, "file-issues", c.github.FileIssues, "Open an issue in the -github-repo repository for every untracked flaky test")
+	flag.StringVar(&issueTemplate, "issue-template", issueTemplate, "Go template file for the body of the filed issues")
+	flag.BoolVar(&useJira, "jira", useJira, "Look for the Jira bugs about the top flaky tests, by test name or failure message")
+	flag.StringVar(&c.jira.Url, "jira-url", c.jira.Url, "Jira url")
+	flag.StringVar(&c.jira.Project, "jira-project", c.jira.Project, "Jira project where the bugs are searched")
+	flag.StringVar(&c.jira.Token, "jira-token", c.jira.Token, "Jira personal access token (default $JIRA_TOKEN)")
+	flag.IntVar(&c.jira.Top, "jira-top", c.jira.Top, "Number of flaky tests looked up in Jira for every job")
+	flag.StringVar(&c.pushgatewayUrl, "pushgateway", c.pushgatewayUrl, "Prometheus Pushgateway url where the jobs health metrics are pushed after the analysis")
+	flag.StringVar(&c.controller.Url, "release-controller", c.controller.Url, "Release controller url, where %s is replaced by the stream architecture")
+	flag.DurationVar(&interval, "interval", interval, "If set, keep running and analyze the jobs again with this interval, notifying only the changed results")
+	flag.StringVar(&listenAddr, "listen", listenAddr, "Address where the serve command listens")
+	flag.DurationVar(&refreshInterval, "refresh", refreshInterval, "How often the serve command analyzes the jobs again")
+	flag.IntVar(&c.slack.Top, "slack-top", c.slack.Top, "Number of flaky tests reported in the Slack notifications")
+	flag.BoolVar(&quiet, "quiet", quiet, "Log only the warnings and the errors")
+	flag.BoolVar(&verbose, "verbose", verbose, "Log also the debug messages, like the retried downloads")
+	flag.BoolVar(&checkUpdate, "check-update", checkUpdate, "Make the version command also tell if a newer release is available on GitHub")
+	caBundle := flag.String("ca-bundle", "", "PEM file with additional CA certificates to trust, e.g. for MITM proxies")
+	configFile := flag.String("config", "", "YAML file with the options to use, overridden by the command line ones. The tests to ignore are listed under the ignore key")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [clean | trend | serve | compare <window> <window> | version]\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "  clean\tRemove all the cached data")
+		fmt.Fprintln(flag.CommandLine.Output(), "  trend\tChart the tests pass rate and the number of flaky tests over time")
+		fmt.Fprintln(flag.CommandLine.Output(), "  serve\tServe the reports of the jobs as HTML, JSON and Prometheus metrics, analyzing them again every -refresh interval")
+		fmt.Fprintln(flag.CommandLine.Output(), "  compare <since>..<until> <since>..<until>\n\tReport the tests whose flakiness changed between two time windows, e.g. compare 2021-10-01..2021-10-07 2021-10-08..2021-10-14")
+		fmt.Fprintln(flag.CommandLine.Output(), "  version\tShow the build details, and with -check-update if a newer release is available")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *configFile != "" {
+		if err := applyConfig(*configFile, opts); err != nil {
+			fatal("Unable to apply the config", "file", *configFile, "err", err)
+		}
+	}
+	c.versions = versions
+
+	if quiet && verbose {
+		fatal("The quiet and verbose options are mutually exclusive")
+	}
+	if quiet {
+		setupLogging(slog.LevelWarn)
+	} else if verbose {
+		setupLogging(slog.LevelDebug)
+	}
+
+	// Not used as the flag default, to avoid showing it in the help
+	if client.AuthToken == "" {
+		client.AuthToken = os.Getenv("AUTH_TOKEN")
+	}
+	if c.github.Token == "" {
+		c.github.Token = os.Getenv("GITHUB_TOKEN")
+	}
+	if c.jira.Token == "" {
+		c.jira.Token = os.Getenv("JIRA_TOKEN")
+	}
+
+	if flag.Arg(0) == "clean" {
+		slog.Info("Removing the cache", "dir", opts.CacheDir)
+		err := os.RemoveAll(opts.CacheDir)
+		if err != nil {
+			fatal("Unable to remove the cache", "dir", opts.CacheDir, "err", err)
+		}
+		return
+	}
+
+	// The client used for all the downloads. Proxies are configured
+	// through the HTTPS_PROXY and NO_PROXY environment variables
+	httpClient := http.DefaultClient
+	if *caBundle != "" {
+		hc, err := gcs.NewHttpClient(*caBundle)
+		if err != nil {
+			fatal("Unable to load the CA bundle", "file", *caBundle, "err", err)
+		}
+		httpClient = hc
+	}
+	client.Fetcher = httpClient
+	client.CacheDir = filepath.Join(opts.CacheDir, "http")
+	// The fixtures must not depend on what was already cached
+	if replayDir != "" {
+		client.Fetcher = &gcs.ReplayingFetcher{Dir: replayDir}
+		client.CacheDir = ""
+	} else if recordDir != "" {
+		client.Fetcher = &gcs.RecordingFetcher{Next: httpClient, Dir: recordDir}
+		client.CacheDir = ""
+	}
+	client.Limiter = gcs.NewRateLimiter(rateLimit)
+	c.github.Fetcher = client.Fetcher
+	c.jira.Fetcher = client.Fetcher
+	c.slack.Fetcher = client.Fetcher
+
+	if flag.Arg(0) == "version" {
+		var gh *flakes.Github
+		if checkUpdate {
+			if client.Offline {
+				fatal("Unable to check for updates in offline mode")
+			}
+			gh = c.github
+		}
+		if err := printVersion(context.Background(), gh); err != nil {
+			fatal("Unable to check for updates", "err", err)
+		}
+		return
+	}
+
+	switch c.output {
+	case "text", "json", "csv", "html", "markdown", "prometheus":
+	default:
+		fatal("Unsupported output format", "output", c.output)
+	}
+	if !opts.Since.IsZero() && !opts.Until.IsZero() && !opts.Since.Before(opts.Until) {
+		fatal("The since date must not be after the until one", "since", opts.Since, "until", opts.Until)
+	}
+	if opts.FlakeDefinition != "flips" && opts.FlakeDefinition != "failure-rate" {
+		fatal("Unsupported flake definition", "definition", opts.FlakeDefinition)
+	}
+	if opts.NumBuilds < 1 {
+		fatal("The number of builds must be at least 1", "builds", opts.NumBuilds)
+	}
+	if opts.RetainBuilds < 0 {
+		fatal("The number of retained builds must not be negative", "retain", opts.RetainBuilds)
+	}
+	layouts, err := prow.ParseJobLayouts(jobLayouts)
+	if err != nil {
+		fatal("Invalid job layouts", "err", err)
+	}
+	opts.Layouts = layouts
+	if rulesFile != "" {
+		if opts.FailureRules, err = loadFailureRules(rulesFile); err != nil {
+			fatal("Unable to load the failure rules", "file", rulesFile, "err", err)
+		}
+	}
+	if c.slack.Webhooks, err = flakes.ParseSlackWebhooks(slackWebhooks); err != nil {
+		fatal("Invalid Slack webhooks", "err", err)
+	}
+	if c.github.FileIssues && c.github.Repo == "" {
+		fatal("Filing issues requires the -github-repo option")
+	}
+	c.issueTmpl = texttemplate.New("issue")
+	if issueTemplate != "" {
+		c.issueTmpl, err = c.issueTmpl.ParseFiles(issueTemplate)
+		if err == nil {
+			c.issueTmpl = c.issueTmpl.Lookup(filepath.Base(issueTemplate))
+		}
+	} else {
+		c.issueTmpl, err = c.issueTmpl.Parse(flakes.DefaultIssueTemplate)
+	}
+	if err != nil {
+		fatal("Unable to parse the issue template", "err", err)
+	}
+	if !useSippy {
+		c.sippy = nil
+	}
+	if c.github.Repo == "" {
+		c.github = nil
+	}
+	if !useJira {
+		c.jira = nil
+	}
+
+	rs, ok := release.Streams[stream]
+	if !ok {
+		fatal("Unsupported release stream", "stream", stream, "valid", strings.Join(release.StreamNames(), ","))
+	}
+	c.rs = rs
+
+	// Interrupting the analysis cancels the in-flight downloads, without
+	// touching the data already saved for the completed jobs
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	jobNames := []string{}
+	added := make(map[string]bool)
+	addJob := func(name string) {
+		names := []string{name}
+		// Variants are known only for the jobs of the release stream
+		if v, t, ok := rs.SplitJobName(name); ok && includeVariants {
+			names = append(names, rs.JobVariants(v, t)...)
+		}
+		for _, n := range names {
+			if !added[n] {
+				added[n] = true
+				jobNames = append(jobNames, n)
+			}
+		}
+	}
+	isJobName := func(t string) bool {
+		return strings.HasPrefix(t, "periodic-") || strings.HasPrefix(t, "pull-")
+	}
+	for _, t := range jobTests {
+		if isJobName(t) && !strings.Contains(t, "%s") {
+			addJob(t)
+		}
+	}
+	for _, v := range c.versions {
+		for _, t := range jobTests {
+			switch {
+			case strings.Contains(t, "%s"):
+				addJob(fmt.Sprintf(t, v))
+			case !isJobName(t):
+				addJob(rs.JobName(v, t))
+			}
+		}
+	}
+
+	if flag.Arg(0) == "trend" {
+		for _, name := range jobNames {
+			job := flakes.Analyze(ctx, name, opts)
+			if ctx.Err() != nil {
+				slog.Warn("Interrupted, the analysis in progress was not saved")
+				break
+			}
+			if job == nil {
+				continue
+			}
+
+			trend, err := job.Trend(trendPeriod)
+			if err != nil {
+				slog.Error("Unable to read the results", "job", job.Name, "err", err)
+				continue
+			}
+			job.ShowTrend(trend)
+
+			if svgDir != "" {
+				err := gcs.WriteFileAtomically(filepath.Join(svgDir, fmt.Sprintf("%s.svg", job.CacheName())), func(w io.Writer) error {
+					return flakes.WriteTrendSvg(w, job.Name, trend)
+				})
+				if err != nil {
+					slog.Error("Unable to write the trend chart", "job", job.Name, "err", err)
+				}
+			}
+		}
+		return
+	}
+
+	if flag.Arg(0) == "serve" {
+		if refreshInterval <= 0 {
+			fatal("The refresh interval must be positive", "interval", refreshInterval)
+		}
+		if err := serve(ctx, c, listenAddr, refreshInterval, jobNames); err != nil {
+			fatal("Unable to serve the reports", "addr", listenAddr, "err", err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "compare" {
+		if flag.NArg() != 3 {
+			fatal("The compare command requires two time windows, e.g. compare 2021-10-01..2021-10-07 2021-10-08..2021-10-14")
+		}
+		before, err := flakes.ParseWindow(flag.Arg(1))
+		if err != nil {
+			fatal("Invalid time window", "window", flag.Arg(1), "err", err)
+		}
+		after, err := flakes.ParseWindow(flag.Arg(2))
+		if err != nil {
+			fatal("Invalid time window", "window", flag.Arg(2), "err", err)
+		}
+
+		// Every window is analyzed with its own copy of the options
+		beforeOpts, afterOpts := *opts, *opts
+		beforeOpts.Since, beforeOpts.Until = before.Since, before.Until
+		afterOpts.Since, afterOpts.Until = after.Since, after.Until
+		for _, name := range jobNames {
+			oldJob := flakes.Analyze(ctx, name, &beforeOpts)
+			newJob := flakes.Analyze(ctx, name, &afterOpts)
+			if ctx.Err() != nil {
+				slog.Warn("Interrupted, the analysis in progress was not saved")
+				break
+			}
+			if oldJob != nil && newJob != nil {
+				flakes.ShowWindowsComparison(oldJob, newJob, before, after)
+			}
+		}
+		return
+	}
+
+	// The notifications already sent, to skip the unchanged jobs when
+	// analyzing them again
+	notified := map[string]string{}
+	for {
+		c.runAnalysis(ctx, jobNames, notified)
+		if interval <= 0 || ctx.Err() != nil {
+			return
+		}
+
+		slog.Info("Waiting for the next analysis", "interval", interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected map[string][]string
+		wantErr  bool
+	}{
+		{
+			name:   "scalars",
+			config: "---\nnum-builds: 20\nsippy: true # also the pass rates\n",
+			expected: map[string][]string{
+				"num-builds": {"20"},
+				"sippy":      {"true"},
+			},
+		},
+		{
+			name:   "flow list",
+			config: `versions: ["4.9", '4.10', ]`,
+			expected: map[string][]string{
+				"versions": {"4.9", "4.10"},
+			},
+		},
+		{
+			name:   "block list",
+			config: "ignore:\n  - \"[sig-arch] Monitor cluster # not a comment\"\n  - 'it''s flaky'\n\ninclude-tests:\n  - ^\\[sig-network\\]\n",
+			expected: map[string][]string{
+				"ignore":        {"[sig-arch] Monitor cluster # not a comment", "it's flaky"},
+				"include-tests": {`^\[sig-network\]`},
+			},
+		},
+		{
+			name:   "empty list",
+			config: "versions: []\nignore:\n",
+			expected: map[string][]string{
+				"versions": {},
+				"ignore":   {},
+			},
+		},
+		{
+			name:    "list item without a key",
+			config:  "- 4.10\n",
+			wantErr: true,
+		},
+		{
+			name:    "missing key",
+			config:  "num-builds 20\n",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated string",
+			config:  "versions:\n  - '4.10\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := ioutil.WriteFile(path, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := loadConfig(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(config, tt.expected) {
+				t.Errorf("expected %q, got %q", tt.expected, config)
+			}
+		})
+	}
+}
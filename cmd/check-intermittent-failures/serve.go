@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/andfasano/metal-ipi-releases/internal/flakes"
+)
+
+// dashboard holds the reports served by the serve command, rendered
+// after every analysis
+type dashboard struct {
+	mu       sync.RWMutex
+	updated  time.Time
+	html     []byte
+	flakes   []byte
+	payloads []byte
+	metrics  []byte
+}
+
+// refresh analyzes again all the jobs and renders the reports, keeping
+// the previous ones if the analysis is interrupted
+func (d *dashboard) refresh(ctx context.Context, c *command, jobNames []string) error {
+	jobs := []*flakes.Job{}
+	for _, name := range jobNames {
+		job := flakes.Analyze(ctx, name, c.opts)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if job == nil {
+			continue
+		}
+		c.enrichJob(ctx, job)
+		jobs = append(jobs, job)
+	}
+	payloads := c.controller.PayloadsStatus(ctx, c.rs, c.versions)
+
+	html := bytes.Buffer{}
+	if err := flakes.WriteHtmlReport(&html, jobs, payloads); err != nil {
+		return err
+	}
+	records := []flakes.FlakeRecord{}
+	for _, job := range jobs {
+		records = append(records, job.FlakeRecords()...)
+	}
+	flakyTests := bytes.Buffer{}
+	if err := flakes.WriteFlakeRecords(&flakyTests, "json", records); err != nil {
+		return err
+	}
+	payloadsJson, err := json.MarshalIndent(payloads, "", "  ")
+	if err != nil {
+		return err
+	}
+	metrics := bytes.Buffer{}
+	if err := flakes.WriteMetrics(ctx, &metrics, jobs, c.controller, c.rs, c.versions); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.updated = time.Now()
+	d.html, d.flakes, d.payloads, d.metrics = html.Bytes(), flakyTests.Bytes(), payloadsJson, metrics.Bytes()
+	return nil
+}
+
+// handler serves one of the rendered reports
+func (d *dashboard) handler(contentType string, report func() []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d.mu.RLock()
+		body, updated := report(), d.updated
+		d.mu.RUnlock()
+
+		if body == nil {
+			http.Error(w, "The first analysis is still in progress", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+		w.Write(body)
+	}
+}
+
+// serve runs a web server with the reports of the jobs, analyzing them
+// again every refresh interval, until the context is canceled
+func serve(ctx context.Context, c *command, addr string, refresh time.Duration, jobNames []string) error {
+	d := &dashboard{}
+	html := d.handler("text/html; charset=utf-8", func() []byte { return d.html })
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		html(w, r)
+	})
+	mux.HandleFunc("/flakes.json", d.handler("application/json", func() []byte { return d.flakes }))
+	mux.HandleFunc("/payloads.json", d.handler("application/json", func() []byte { return d.payloads }))
+	mux.HandleFunc("/metrics", d.handler("text/plain; version=0.0.4", func() []byte { return d.metrics }))
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		ticker := time.NewTicker(refresh)
+		defer ticker.Stop()
+		for {
+			slog.Info("Refreshing the reports")
+			if err := d.refresh(ctx, c, jobNames); err != nil && ctx.Err() == nil {
+				slog.Error("Unable to refresh the reports", "err", err)
+			}
+			select {
+			case <-ctx.Done():
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				server.Shutdown(shutdownCtx)
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	slog.Info("Serving the reports", "addr", addr)
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
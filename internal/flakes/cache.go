@@ -0,0 +1,590 @@
+package flakes
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/andfasano/metal-ipi-releases/internal/gcs"
+	"github.com/andfasano/metal-ipi-releases/internal/junit"
+	"github.com/andfasano/metal-ipi-releases/internal/prow"
+	_ "modernc.org/sqlite"
+)
+
+// testStore keeps the history of every test analyzed for a job
+type testStore interface {
+	Get(name string) (TestHistory, bool)
+	Put(name string, th TestHistory) error
+	ForEach(fn func(name string, th TestHistory))
+}
+
+// memoryStore keeps the tests history in memory
+type memoryStore map[string]TestHistory
+
+func (m memoryStore) Get(name string) (TestHistory, bool) {
+	th, ok := m[name]
+	return th, ok
+}
+
+func (m memoryStore) Put(name string, th TestHistory) error {
+	m[name] = th
+	return nil
+}
+
+func (m memoryStore) ForEach(fn func(name string, th TestHistory)) {
+	for k, v := range m {
+		fn(k, v)
+	}
+}
+
+// diskStore keeps the tests history on disk, one file per test, so that
+// very large scans do not need to hold the whole aggregation in memory
+type diskStore struct {
+	dir string
+}
+
+type diskStoreEntry struct {
+	Name    string
+	History TestHistory
+}
+
+func (d diskStore) path(name string) string {
+	return filepath.Join(d.dir, fmt.Sprintf("%x.gob", sha1.Sum([]byte(name))))
+}
+
+func (d diskStore) read(path string) (diskStoreEntry, error) {
+	entry := diskStoreEntry{}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return entry, err
+	}
+	defer f.Close()
+
+	err = gob.NewDecoder(bufio.NewReader(f)).Decode(&entry)
+	return entry, err
+}
+
+func (d diskStore) Get(name string) (TestHistory, bool) {
+	entry, err := d.read(d.path(name))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Error while reading the history", "job", name, "err", err)
+		}
+		return TestHistory{}, false
+	}
+
+	return entry.History, true
+}
+
+func (d diskStore) Put(name string, th TestHistory) error {
+	return gcs.WriteFileAtomically(d.path(name), func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(diskStoreEntry{
+			Name:    name,
+			History: th,
+		})
+	})
+}
+
+func (d diskStore) ForEach(fn func(name string, th TestHistory)) {
+	files, err := filepath.Glob(filepath.Join(d.dir, "*.gob"))
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		entry, err := d.read(f)
+		if err != nil {
+			slog.Warn("Error while reading the history", "file", f, "err", err)
+			continue
+		}
+		fn(entry.Name, entry.History)
+	}
+}
+
+// resultsSchema is the schema of the results database, where the tests
+// outcomes of every analyzed build are kept for ad-hoc queries, e.g.
+//
+//	sqlite3 <cache-dir>/results.db "SELECT job, COUNT(*) FROM results
+//	  JOIN builds USING (job, build) WHERE outcome = 'failed' GROUP BY job"
+//
+// The analysis of every job is saved there too, by name, except for the
+// tests history that is rebuilt from the results
+const resultsSchema = `
+CREATE TABLE IF NOT EXISTS builds (
+	job       TEXT NOT NULL,
+	build     TEXT NOT NULL,
+	timestamp TEXT NOT NULL,
+	passed    INTEGER NOT NULL,
+	PRIMARY KEY (job, build)
+);
+CREATE TABLE IF NOT EXISTS results (
+	job      TEXT NOT NULL,
+	build    TEXT NOT NULL,
+	test     TEXT NOT NULL,
+	outcome  TEXT NOT NULL,
+	duration REAL NOT NULL,
+	failure  TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS results_build ON results (job, build);
+CREATE INDEX IF NOT EXISTS results_test ON results (test);
+CREATE TABLE IF NOT EXISTS analyses (
+	name           TEXT PRIMARY KEY,
+	last_build     TEXT NOT NULL,
+	from_ts        INTEGER NOT NULL,
+	to_ts          INTEGER NOT NULL,
+	failure_streak INTEGER NOT NULL,
+	last_passed    INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS analyzed_builds (
+	name      TEXT NOT NULL,
+	build     TEXT NOT NULL,
+	timestamp INTEGER NOT NULL,
+	passed    INTEGER NOT NULL,
+	edge      TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS skipped_builds (
+	name     TEXT NOT NULL,
+	build    TEXT NOT NULL,
+	category TEXT NOT NULL,
+	reason   TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS install_failures (
+	name      TEXT NOT NULL,
+	build     TEXT NOT NULL,
+	duration  INTEGER NOT NULL,
+	timed_out INTEGER NOT NULL,
+	phase     TEXT NOT NULL,
+	reason    TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS build_durations (
+	name     TEXT NOT NULL,
+	build    TEXT NOT NULL,
+	duration INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS step_durations (
+	name     TEXT NOT NULL,
+	step     TEXT NOT NULL,
+	duration INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS provisioning_errors (
+	name     TEXT NOT NULL,
+	category TEXT NOT NULL,
+	example  TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS build_lists (
+	name  TEXT NOT NULL,
+	list  TEXT NOT NULL,
+	key   TEXT NOT NULL,
+	build TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS build_paths (
+	name  TEXT NOT NULL,
+	build TEXT NOT NULL,
+	path  TEXT NOT NULL
+);
+`
+
+// analysisTables are the tables where the job analyses are saved
+var analysisTables = []string{"analyses", "analyzed_builds", "skipped_builds", "install_failures", "build_durations",
+	"step_durations", "provisioning_errors", "build_lists", "build_paths"}
+
+// resultsWriter records the tests outcomes of the analyzed builds of a job
+// in the results database, shared by all the jobs
+type resultsWriter struct {
+	job string
+	db  *sql.DB
+}
+
+func (o *Options) resultsFilename() string {
+	return filepath.Join(o.CacheDir, "results.db")
+}
+
+// openResults opens the results database, creating it when missing
+func (j *Job) openResults() (*resultsWriter, error) {
+	if err := os.MkdirAll(j.opts.CacheDir, 0755); err != nil {
+		return nil, err
+	}
+
+	// Other runs may be writing at the same time
+	db, err := sql.Open("sqlite", j.opts.resultsFilename()+"?_pragma=busy_timeout(10000)&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	if err := initResults(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", j.opts.resultsFilename(), err)
+	}
+	return &resultsWriter{job: j.Name, db: db}, nil
+}
+
+// initResults creates the results database tables, dropping the ones
+// saved with another format version, whose builds are analyzed again
+func initResults(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version, tables int
+	if err := tx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&tables); err != nil {
+		return err
+	}
+	if version != cacheVersion && tables > 0 {
+		slog.Warn("Discarding data saved with another format version", "version", version)
+		rows, err := tx.Query("SELECT name FROM sqlite_master WHERE type = 'table'")
+		if err != nil {
+			return err
+		}
+		names := []string{}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return err
+			}
+			names = append(names, name)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, name := range names {
+			if _, err := tx.Exec(fmt.Sprintf("DROP TABLE %q", name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := tx.Exec(resultsSchema); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", cacheVersion)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Write records the outcome of all the tests of a build, every attempt
+// included, replacing the ones recorded when the build was analyzed before
+func (rw *resultsWriter) Write(b *prow.Build, suite *junit.TestSuite) error {
+	tx, err := rw.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ts := time.Unix(b.Finished.Timestamp, 0).UTC().Format(time.RFC3339)
+	if _, err := tx.Exec("INSERT OR REPLACE INTO builds VALUES (?, ?, ?, ?)", rw.job, b.Id, ts, b.Finished.Passed); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM results WHERE job = ? AND build = ?", rw.job, b.Id); err != nil {
+		return err
+	}
+
+	insert, err := tx.Prepare("INSERT INTO results VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for _, tc := range suite.TestCases {
+		outcome := "passed"
+		if tc.IsFailure() {
+			outcome = "failed"
+		} else if tc.IsSkipped() {
+			outcome = "skipped"
+		}
+		if _, err := insert.Exec(rw.job, b.Id, tc.Name, outcome, tc.Time, tc.Failure); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (rw *resultsWriter) Close() error {
+	return rw.db.Close()
+}
+
+// readResults returns the tests outcomes recorded for the builds of the
+// job finished since the given time, every attempt included, by build id
+func (j *Job) readResults(from int64) (map[string]*junit.TestSuite, error) {
+	results, err := j.openResults()
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	rows, err := results.db.Query(`SELECT build, test, outcome, duration, failure FROM results JOIN builds USING (job, build)
+		WHERE job = ? AND timestamp >= ? ORDER BY results.rowid`, j.Name, time.Unix(from, 0).UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suites := make(map[string]*junit.TestSuite)
+	for rows.Next() {
+		var build, outcome string
+		tc := junit.TestCase{}
+		if err := rows.Scan(&build, &tc.Name, &outcome, &tc.Time, &tc.Failure); err != nil {
+			return nil, err
+		}
+		if outcome == "skipped" {
+			tc.Skipped.Message = outcome
+		}
+
+		suite, ok := suites[build]
+		if !ok {
+			suite = &junit.TestSuite{}
+			suites[build] = suite
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+	return suites, rows.Err()
+}
+
+// cacheVersion is the format version of the results database, to be
+// increased at every incompatible change of its schema or of JobHistory
+const cacheVersion = 19
+
+// Serialize saves the job analysis in the results database
+func (j *Job) Serialize() {
+	slog.Info("Saving data", "job", j.Name)
+	if err := j.saveHistory(); err != nil {
+		slog.Error("Error while serializing data", "job", j.Name, "err", err)
+	}
+}
+
+// saveHistory replaces the saved job analysis with the current one. The
+// tests history is not saved, since it is rebuilt from the results
+func (j *Job) saveHistory() error {
+	results, err := j.openResults()
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+
+	tx, err := results.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	name := j.CacheName()
+	for _, table := range analysisTables {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE name = ?", table), name); err != nil {
+			return err
+		}
+	}
+
+	// The first error stops all the following inserts
+	insert := func(table string, values ...interface{}) {
+		if err != nil {
+			return
+		}
+		query := fmt.Sprintf("INSERT INTO %s VALUES (?%s)", table, strings.Repeat(", ?", len(values)))
+		_, err = tx.Exec(query, append([]interface{}{name}, values...)...)
+	}
+	insertBuilds := func(list, key string, ids []string) {
+		for _, id := range ids {
+			insert("build_lists", list, key, id)
+		}
+	}
+
+	h := j.history
+	insert("analyses", h.LastBuild, h.From, h.To, h.FailureStreak, h.LastPassed)
+	for _, bs := range h.Builds {
+		insert("analyzed_builds", bs.Id, bs.Timestamp, bs.Passed, bs.Edge)
+	}
+	for id, reason := range h.Skipped {
+		insert("skipped_builds", id, h.SkipCategories[id], reason)
+	}
+	for _, f := range h.InstallFailures {
+		insert("install_failures", f.Build, int64(f.Duration), f.TimedOut, f.Phase, f.Reason)
+	}
+	for _, d := range h.BuildDurations {
+		insert("build_durations", d.Build, int64(d.Duration))
+	}
+	for step, durations := range h.StepDurations {
+		for _, d := range durations {
+			insert("step_durations", step, int64(d))
+		}
+	}
+	insertBuilds("teardown", "", h.TeardownFailures)
+	insertBuilds("e2e", "", h.E2eFailures)
+	insertBuilds("unclassified", "", h.UnclassifiedFailures)
+	for step, ids := range h.StepFailures {
+		insertBuilds("step", step, ids)
+	}
+	for label, ids := range h.FailureLabels {
+		insertBuilds("label", label, ids)
+	}
+	for category, pe := range h.ProvisioningErrors {
+		insert("provisioning_errors", category, pe.Example)
+		insertBuilds("provisioning", category, pe.Builds)
+	}
+	for id, path := range j.BuildPaths {
+		insert("build_paths", id, path)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// If saved data are found, let's reuse them, rebuilding the tests history
+// from the results of the analyzed builds
+func (j *Job) Deserialize() bool {
+	err := j.loadHistory()
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		slog.Error("Error while deserializing data", "job", j.Name, "err", err)
+		j.history = NewJob(j.Name, j.opts).history
+		j.BuildPaths = make(map[string]string)
+		return false
+	}
+	return true
+}
+
+// loadHistory reads the saved job analysis
+func (j *Job) loadHistory() error {
+	results, err := j.openResults()
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+
+	name := j.CacheName()
+	h := NewJob(j.Name, j.opts).history
+	paths := make(map[string]string)
+	err = results.db.QueryRow("SELECT last_build, from_ts, to_ts, failure_streak, last_passed FROM analyses WHERE name = ?", name).
+		Scan(&h.LastBuild, &h.From, &h.To, &h.FailureStreak, &h.LastPassed)
+	if err != nil {
+		return err
+	}
+
+	// Rows are read in the order they were saved
+	query := func(columns, table string, scan func(rows *sql.Rows) error) error {
+		rows, err := results.db.Query(fmt.Sprintf("SELECT %s FROM %s WHERE name = ? ORDER BY rowid", columns, table), name)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			if err := scan(rows); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+
+	builds := []BuildSummary{}
+	err = query("build, timestamp, passed, edge", "analyzed_builds", func(rows *sql.Rows) error {
+		bs := BuildSummary{}
+		err := rows.Scan(&bs.Id, &bs.Timestamp, &bs.Passed, &bs.Edge)
+		builds = append(builds, bs)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = query("build, category, reason", "skipped_builds", func(rows *sql.Rows) error {
+		var id, category, reason string
+		err := rows.Scan(&id, &category, &reason)
+		h.Skipped[id] = reason
+		h.SkipCategories[id] = category
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = query("build, duration, timed_out, phase, reason", "install_failures", func(rows *sql.Rows) error {
+		f := prow.InstallFailure{}
+		err := rows.Scan(&f.Build, &f.Duration, &f.TimedOut, &f.Phase, &f.Reason)
+		h.InstallFailures = append(h.InstallFailures, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = query("build, duration", "build_durations", func(rows *sql.Rows) error {
+		d := BuildDuration{}
+		err := rows.Scan(&d.Build, &d.Duration)
+		h.BuildDurations = append(h.BuildDurations, d)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = query("step, duration", "step_durations", func(rows *sql.Rows) error {
+		var step string
+		var d time.Duration
+		err := rows.Scan(&step, &d)
+		h.StepDurations[step] = append(h.StepDurations[step], d)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = query("category, example", "provisioning_errors", func(rows *sql.Rows) error {
+		var category, example string
+		err := rows.Scan(&category, &example)
+		h.ProvisioningErrors[category] = ProvisioningError{Example: example}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = query("list, key, build", "build_lists", func(rows *sql.Rows) error {
+		var list, key, id string
+		if err := rows.Scan(&list, &key, &id); err != nil {
+			return err
+		}
+		switch list {
+		case "teardown":
+			h.TeardownFailures = append(h.TeardownFailures, id)
+		case "e2e":
+			h.E2eFailures = append(h.E2eFailures, id)
+		case "unclassified":
+			h.UnclassifiedFailures = append(h.UnclassifiedFailures, id)
+		case "step":
+			h.StepFailures[key] = append(h.StepFailures[key], id)
+		case "label":
+			h.FailureLabels[key] = append(h.FailureLabels[key], id)
+		case "provisioning":
+			pe := h.ProvisioningErrors[key]
+			pe.Builds = append(pe.Builds, id)
+			h.ProvisioningErrors[key] = pe
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = query("build, path", "build_paths", func(rows *sql.Rows) error {
+		var id, path string
+		err := rows.Scan(&id, &path)
+		paths[id] = path
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	j.history = h
+	j.BuildPaths = paths
+	return j.rebuildTests(builds)
+}
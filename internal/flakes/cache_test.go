@@ -0,0 +1,82 @@
+package flakes
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/andfasano/metal-ipi-releases/internal/prow"
+)
+
+func TestDeserialize(t *testing.T) {
+	tests := []struct {
+		name     string
+		saved    bool
+		alter    func(db *sql.DB) error
+		expected bool
+	}{
+		{
+			name:     "missing",
+			expected: false,
+		},
+		{
+			name:     "saved",
+			saved:    true,
+			expected: true,
+		},
+		{
+			name:  "other version",
+			saved: true,
+			alter: func(db *sql.DB) error {
+				_, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", cacheVersion-1))
+				return err
+			},
+			expected: false,
+		},
+		{
+			name:  "missing results",
+			saved: true,
+			alter: func(db *sql.DB) error {
+				_, err := db.Exec("DELETE FROM results WHERE build = '102'")
+				return err
+			},
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed := parseFixtureJob(t)
+			parsed.history.InstallFailures = []prow.InstallFailure{{Build: "106", Phase: "bootstrap", Reason: "timeout"}}
+			parsed.history.FailureLabels["dns"] = []string{"104", "102"}
+			parsed.history.ProvisioningErrors["inspection"] = ProvisioningError{Builds: []string{"103"}, Example: "timed out"}
+			parsed.BuildPaths["103"] = "pr-logs/pull/1/103"
+			if tt.saved {
+				parsed.Serialize()
+			}
+			if tt.alter != nil {
+				db, err := sql.Open("sqlite", parsed.opts.resultsFilename())
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = tt.alter(db)
+				db.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			j := NewJob(fixtureJob, parsed.opts)
+			if got := j.Deserialize(); got != tt.expected {
+				t.Fatalf("expected %t, got %t", tt.expected, got)
+			}
+			if tt.expected && !reflect.DeepEqual(j.history, parsed.history) {
+				t.Errorf("expected the saved history %+v, got %+v", parsed.history, j.history)
+			}
+			if tt.expected && !reflect.DeepEqual(j.BuildPaths, parsed.BuildPaths) {
+				t.Errorf("expected the saved build paths %v, got %v", parsed.BuildPaths, j.BuildPaths)
+			}
+		})
+	}
+}
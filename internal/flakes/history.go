@@ -0,0 +1,974 @@
+package flakes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/andfasano/metal-ipi-releases/internal/gcs"
+	"github.com/andfasano/metal-ipi-releases/internal/junit"
+	"github.com/andfasano/metal-ipi-releases/internal/prow"
+	"github.com/andfasano/metal-ipi-releases/internal/release"
+)
+
+// TestHistory is used to accumulate the detected flakes for given test
+type TestHistory struct {
+	// The test outcome in the newest analyzed build
+	LastState bool
+	Flakes    float32
+	// When the test flaked for the first and the last time
+	FirstSeen int64
+	LastSeen  int64
+	// The builds where the test changed its state
+	Builds []string
+	// Set to the newest analyzed build when the test failed in it, that
+	// is counted as half a flake until a newer build is analyzed
+	PendingFlake string
+	// The builds where the test failed, from the oldest one
+	FailedBuilds []string
+	// How many times the test was run, skipped ones excluded, and failed
+	Runs     int
+	Failures int
+	// The consecutive failures up to the newest analyzed build, and
+	// the longest sequence of consecutive failures
+	Streak    int
+	MaxStreak int
+	// The distinct ways the test failed, keyed by their signature
+	FailureModes map[string]FailureMode
+	// How long the test lasted when it passed, from the oldest build
+	Durations []time.Duration
+	// The builds where the test failed but passed when retried within
+	// the same run, from the oldest one
+	InRunFlakeBuilds []string
+}
+
+// FailureMode groups the failures of a test with similar messages
+type FailureMode struct {
+	Count int
+	// The first failure message found with this signature
+	Example string
+	// The newest build where the test failed this way
+	LastBuild string
+}
+
+var (
+	failureUuidRe = regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`)
+	failureTimeRe = regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?|\b\d{2}:\d{2}:\d{2}(\.\d+)?`)
+	failureIpRe   = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`)
+	failureIdRe   = regexp.MustCompile(`\b[[:alnum:]]*\d[[:alnum:]]*\b`)
+	failureNumRe  = regexp.MustCompile(`\d+`)
+)
+
+// failureSignature normalizes a failure message, so that failures differing
+// only by timestamps, ids, generated names or numbers share the same signature.
+// Only the first line is considered, since it usually carries the failure reason
+func failureSignature(message string) string {
+	line := ""
+	for _, l := range strings.Split(message, "\n") {
+		if line = strings.TrimSpace(l); line != "" {
+			break
+		}
+	}
+
+	line = failureUuidRe.ReplaceAllString(line, "<uuid>")
+	line = failureTimeRe.ReplaceAllString(line, "<time>")
+	line = failureIpRe.ReplaceAllString(line, "<ip>")
+	line = failureIdRe.ReplaceAllStringFunc(line, func(m string) string {
+		// Words mixing letters and digits are likely ids or generated names
+		if strings.IndexFunc(m, unicode.IsLetter) >= 0 {
+			return "<id>"
+		}
+		return failureNumRe.ReplaceAllString(m, "<n>")
+	})
+
+	if len(line) > 200 {
+		line = line[:200]
+	}
+	return line
+}
+
+// addFailure records the failure message of the test in the given build
+func (th *TestHistory) addFailure(b *prow.Build, message string) {
+	if th.FailureModes == nil {
+		th.FailureModes = make(map[string]FailureMode)
+	}
+
+	signature := failureSignature(message)
+	fm, ok := th.FailureModes[signature]
+	if !ok {
+		fm.Example = strings.TrimSpace(message)
+		if len(fm.Example) > 1000 {
+			fm.Example = fm.Example[:1000]
+		}
+	}
+	fm.Count++
+	fm.LastBuild = b.Id
+	th.FailureModes[signature] = fm
+
+	th.FailedBuilds = append(th.FailedBuilds, b.Id)
+}
+
+// PassRate returns the ratio of the test runs that passed
+func (th TestHistory) PassRate() float32 {
+	if th.Runs == 0 {
+		return 1
+	}
+	return float32(th.Runs-th.Failures) / float32(th.Runs)
+}
+
+// JobHistory keeps all the relevant info for the analyzed builds
+// for a given job
+type JobHistory struct {
+	From        int64
+	To          int64
+	TotalBuilds float32
+	// The newest analyzed build, later runs only fetch the newer ones
+	LastBuild string
+	Data      map[string]TestHistory
+	// Builds that could not be analyzed, with the reason why
+	Skipped map[string]string
+	// The category of the reason why every skipped build was not analyzed
+	SkipCategories map[string]string
+	// Builds where the cluster deprovisioning failed
+	TeardownFailures []string
+	// Builds where the cluster installation failed
+	InstallFailures []prow.InstallFailure
+	// Builds where the cluster was installed but the e2e tests failed
+	E2eFailures []string
+	// How many of the newest builds failed in a row, and when the
+	// newest passing build finished
+	FailureStreak int
+	LastPassed    int64
+	// The analyzed builds, from the newest to the oldest
+	Builds []BuildSummary
+	// The duration of every build, from the newest to the oldest
+	BuildDurations []BuildDuration
+	// The duration of every workflow step, from the newest build to the oldest
+	StepDurations map[string][]time.Duration
+	// The builds where every workflow step failed
+	StepFailures map[string][]string
+	// The analyzed builds of the upgrade jobs, by upgrade edge
+	UpgradeEdges map[string]UpgradeEdge
+	// The failed builds matching every known failure signature, and the
+	// ones not matching any, from the newest to the oldest
+	FailureLabels        map[string][]string
+	UnclassifiedFailures []string
+	// The provisioning errors found in the metal3 pods logs of the
+	// failed builds, by category
+	ProvisioningErrors map[string]ProvisioningError
+}
+
+// UpgradeEdge keeps track of the builds upgrading between the same versions
+type UpgradeEdge struct {
+	Builds       int
+	FailedBuilds int
+	// How many times every test failed
+	TestFailures map[string]int
+}
+
+// ProvisioningError is a category of errors logged by the metal3 pods
+type ProvisioningError struct {
+	// The builds logging the error, from the newest one
+	Builds []string
+	// The newest error message found
+	Example string
+}
+
+// BuildSummary is the outcome of an analyzed build
+type BuildSummary struct {
+	Id          string
+	Timestamp   int64
+	Passed      bool
+	FailedTests int
+	// The upgrade edge of the builds of the upgrade jobs
+	Edge string
+}
+
+// BuildDuration is the wall-clock duration of a build
+type BuildDuration struct {
+	Build    string
+	Duration time.Duration
+}
+
+// Job is a Prow job, and the history of its analyzed builds
+type Job struct {
+	*prow.Job
+	builds  []*prow.Build
+	history JobHistory
+	// The tests history read from the disk store, loaded once per report
+	loaded memoryStore
+	// The Sippy pass rates of the flaky tests, when requested
+	sippy map[string]*release.SippySummary
+	// The GitHub issues tracking the flaky tests, when requested. Tests
+	// looked up without finding any issue are mapped to nil
+	issues map[string]*GithubIssue
+	// The repository of the issues, once looked up
+	issuesRepo string
+	// The Jira bugs matching the top flaky tests, when requested
+	bugs map[string][]JiraBug
+	// How the job is analyzed and reported
+	opts *Options
+}
+
+// CacheName is used to name the saved job analysis and its index files.
+// Builds analyzed within a time window are kept apart from the others
+func (j *Job) CacheName() string {
+	if !j.opts.windowed() {
+		return j.Name
+	}
+
+	window := func(t time.Time) string {
+		if t.IsZero() {
+			return "any"
+		}
+		return t.Format("20060102")
+	}
+	return fmt.Sprintf("%s-%s-%s", j.Name, window(j.opts.Since), window(j.opts.Until.AddDate(0, 0, -1)))
+}
+
+// tests returns the store holding the job tests history
+func (j *Job) tests() testStore {
+	if j.opts.LowMemory {
+		return diskStore{dir: filepath.Join(j.opts.CacheDir, fmt.Sprintf("%s.index", j.CacheName()))}
+	}
+	return memoryStore(j.history.Data)
+}
+
+// reportTests returns the tests history to report. The disk store is read
+// only once, rather than by every report walking through all the tests
+func (j *Job) reportTests() testStore {
+	ds, ok := j.tests().(diskStore)
+	if !ok {
+		return j.tests()
+	}
+	if j.loaded == nil {
+		j.loaded = memoryStore{}
+		ds.ForEach(func(name string, th TestHistory) {
+			j.loaded[name] = th
+		})
+	}
+	return j.loaded
+}
+
+// NewJob returns the job with the given name, analyzed with the given options
+func NewJob(name string, opts *Options) *Job {
+	return &Job{
+		Job:    prow.NewJob(name, opts.Layouts, opts.Client),
+		builds: []*prow.Build{},
+		opts:   opts,
+		history: JobHistory{
+			Data:               make(map[string]TestHistory),
+			Skipped:            make(map[string]string),
+			SkipCategories:     make(map[string]string),
+			StepDurations:      make(map[string][]time.Duration),
+			StepFailures:       make(map[string][]string),
+			UpgradeEdges:       make(map[string]UpgradeEdge),
+			FailureLabels:      make(map[string][]string),
+			ProvisioningErrors: make(map[string]ProvisioningError),
+		},
+	}
+}
+
+// Analyze updates the saved analysis of the given job with its newest
+// builds. No job is returned when there is nothing to report
+func Analyze(ctx context.Context, name string, opts *Options) *Job {
+	job := NewJob(name, opts)
+	cached := !opts.RebuildCache && job.Deserialize()
+	installFailures := len(job.history.InstallFailures)
+	lastBuild := job.history.LastBuild
+
+	// Only the builds newer than the cached ones are analyzed.
+	// Variants not existing for a given version are just ignored
+	err := job.ListBuilds(ctx, opts.NumBuilds)
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		slog.Error("Unable to list builds", "job", job.Name, "err", err)
+		if !cached {
+			return nil
+		}
+	} else if len(job.builds) > 0 || job.history.LastBuild != lastBuild {
+		// Builds that could not be analyzed move LastBuild forward too,
+		// and their installation failures are classified as well
+		if len(job.builds) > 0 {
+			err = job.ParseTests(ctx)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				slog.Error("Unable to parse the tests", "job", job.Name, "err", err)
+				return nil
+			}
+		}
+
+		failed := []string{}
+		for _, b := range job.builds {
+			if !b.Finished.Passed {
+				failed = append(failed, b.Id)
+			}
+		}
+		for _, f := range job.history.InstallFailures[installFailures:] {
+			failed = append(failed, f.Build)
+		}
+		sort.Slice(failed, func(i, j int) bool {
+			return newerBuild(failed[i], failed[j])
+		})
+		job.classifyFailures(ctx, failed)
+		job.analyzeProvisioning(ctx, failed)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err := job.prune(); err != nil {
+			slog.Warn("Unable to prune the history", "job", job.Name, "err", err)
+		}
+		job.Serialize()
+	}
+	if !cached && job.history.TotalBuilds == 0 {
+		slog.Warn("No builds found", "job", job.Name)
+		return nil
+	}
+	return job
+}
+
+// ListBuilds select the last N builds, for a given job, newer than
+// the ones already analyzed. When a time window is set, all the builds
+// finished within it are selected instead.
+// Build ids are the subfolders of the job artifacts folder
+func (j *Job) ListBuilds(ctx context.Context, numBuilds int) error {
+	slog.Info("Listing builds", "job", j.Name)
+	folders, files, err := j.Client.ListFolder(ctx, j.BuildsUrl())
+	if err != nil {
+		return err
+	}
+
+	// The builds of the pull requests jobs are listed as text files
+	// pointing to their artifacts
+	if j.Presubmit {
+		folders = []string{}
+		for _, f := range files {
+			folders = append(folders, strings.TrimSuffix(f, ".txt"))
+		}
+	}
+
+	buildIds := []string{}
+	re := regexp.MustCompile(`^\d+$`)
+	for _, f := range folders {
+		if re.MatchString(f) && newerBuild(f, j.history.LastBuild) {
+			buildIds = append(buildIds, f)
+		}
+	}
+	sort.Strings(buildIds)
+
+	type candidate struct {
+		build    *prow.Build
+		err      error
+		install  *prow.InstallFailure
+		duration time.Duration
+		skip     string
+	}
+
+	// The newest finished build, skipped ones included, so that the
+	// next runs do not list again the ones that could not be analyzed
+	newest := ""
+
+	// Fetch last N builds, checking as many candidates at once
+	// as the still missing ones. Within a time window, builds are checked
+	// until the first one finished before it
+	windowed := j.opts.windowed()
+	detected := false
+	done := false
+	j.builds = []*prow.Build{}
+	durations := []BuildDuration{}
+	next := len(buildIds) - 1
+	for next >= 0 && !done && (windowed || len(j.builds) < numBuilds) {
+		size := numBuilds - len(j.builds)
+		if windowed {
+			size = j.Client.Concurrency
+		}
+		if size > next+1 {
+			size = next + 1
+		}
+		j.ResolveBuildPaths(ctx, buildIds[next-size+1:next+1], j.opts.PullsFrom, j.opts.PullsTo)
+
+		// The layout is detected from the newest build found
+		for i := next; i > next-size && !detected; i-- {
+			if _, ok := j.BuildPaths[buildIds[i]]; j.Presubmit && !ok {
+				continue
+			}
+			if err := j.DetectLayout(ctx, buildIds[i]); err != nil {
+				slog.Warn("Unable to detect the artifacts layout", "job", j.Name, "err", err)
+			}
+			detected = true
+		}
+
+		candidates := make([]candidate, size)
+		for i := range candidates {
+			candidates[i].build = prow.NewBuild(buildIds[next-i], j.Job)
+		}
+		next -= size
+
+		j.Client.ForEachParallel(len(candidates), func(i int) {
+			c := &candidates[i]
+			if _, ok := j.BuildPaths[c.build.Id]; j.Presubmit && !ok {
+				c.err = errPullOutOfRange
+				return
+			}
+			c.err = c.build.FetchTestStepResult(ctx)
+			if c.err != nil {
+				c.install = c.build.FetchInstallFailure(ctx, j.opts.InstallTimeout)
+				switch {
+				case c.install != nil:
+					c.skip = prow.SkipInstall
+				case gcs.IsNotFound(c.err):
+					c.skip, c.err = c.build.MissingTestStep(ctx)
+				default:
+					c.skip = prow.SkipUnreachable
+				}
+			}
+			if c.err == nil || c.install != nil {
+				duration, err := c.build.FetchDuration(ctx)
+				if err != nil {
+					slog.Warn("Unable to get the build duration", "job", j.Name, "build", c.build.Id, "err", err)
+				}
+				c.duration = duration
+			}
+		})
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		for _, c := range candidates {
+			if c.err == errPullOutOfRange {
+				continue
+			}
+			// Select only finished builds
+			if c.err == nil {
+				ts := time.Unix(c.build.Finished.Timestamp, 0)
+				if !j.opts.Until.IsZero() && !ts.Before(j.opts.Until) {
+					continue
+				}
+				if !j.opts.Since.IsZero() && ts.Before(j.opts.Since) {
+					done = true
+					continue
+				}
+				j.builds = append(j.builds, c.build)
+				if c.duration > 0 {
+					durations = append(durations, BuildDuration{Build: c.build.Id, Duration: c.duration})
+				}
+				if newest == "" {
+					newest = c.build.Id
+				}
+				continue
+			}
+			j.skipBuild(c.build, c.skip, c.err)
+			if c.install != nil {
+				j.addInstallFailure(*c.install)
+				if c.duration > 0 {
+					durations = append(durations, BuildDuration{Build: c.build.Id, Duration: c.duration})
+				}
+			}
+			// Still running or unreachable builds are looked at again later
+			if newest == "" && c.skip != prow.SkipRunning && c.skip != prow.SkipUnreachable {
+				newest = c.build.Id
+			}
+		}
+	}
+	j.addBuildDurations(durations)
+	if newerBuild(newest, j.history.LastBuild) {
+		j.history.LastBuild = newest
+	}
+
+	slog.Info("Found new builds", "job", j.Name, "found", len(buildIds), "selected", len(j.builds))
+
+	return nil
+}
+
+// errPullOutOfRange marks the pull requests jobs builds left out of the
+// configured pull requests range
+var errPullOutOfRange = errors.New("pull request out of range")
+
+// newerBuild reports whether the build id a comes after b
+func newerBuild(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+// addFlake records a change of state of the test in the given build
+func (th *TestHistory) addFlake(b *prow.Build) {
+	th.Flakes += 0.5
+
+	ts := b.Finished.Timestamp
+	if th.FirstSeen == 0 || ts < th.FirstSeen {
+		th.FirstSeen = ts
+	}
+	if ts > th.LastSeen {
+		th.LastSeen = ts
+	}
+	th.Builds = append(th.Builds, b.Id)
+}
+
+// addUpgradeBuild records the outcome of an upgrade build in its edge
+func (j *Job) addUpgradeBuild(b *prow.Build, edge string, suite *junit.TestSuite) {
+	e, ok := j.history.UpgradeEdges[edge]
+	if !ok {
+		e.TestFailures = make(map[string]int)
+	}
+
+	e.Builds++
+	if !b.Finished.Passed {
+		e.FailedBuilds++
+	}
+	for _, tc := range suite.TestCases {
+		if !j.opts.ignoreTest(tc.Name) && tc.IsFailure() {
+			e.TestFailures[tc.Name]++
+		}
+	}
+	j.history.UpgradeEdges[edge] = e
+}
+
+// skipBuild records a build that could not be analyzed, and why, so
+// that it could be reported in the summary
+func (j *Job) skipBuild(b *prow.Build, category string, reason error) {
+	slog.Info("Skipping build", "job", j.Name, "build", b.Id, "category", category, "reason", reason)
+	if j.history.Skipped == nil {
+		j.history.Skipped = make(map[string]string)
+	}
+	if j.history.SkipCategories == nil {
+		j.history.SkipCategories = make(map[string]string)
+	}
+	j.history.Skipped[b.Id] = reason.Error()
+	j.history.SkipCategories[b.Id] = category
+}
+
+// addInstallFailure records the failed installation of a build, unless
+// already recorded
+func (j *Job) addInstallFailure(f prow.InstallFailure) {
+	for _, other := range j.history.InstallFailures {
+		if other.Build == f.Build {
+			return
+		}
+	}
+	j.history.InstallFailures = append(j.history.InstallFailures, f)
+}
+
+// addBuildDurations records the durations of the builds not recorded
+// yet, given from the newest build to the oldest one
+func (j *Job) addBuildDurations(durations []BuildDuration) {
+	recorded := make(map[string]bool)
+	for _, d := range j.history.BuildDurations {
+		recorded[d.Build] = true
+	}
+	added := []BuildDuration{}
+	for _, d := range durations {
+		if !recorded[d.Build] {
+			added = append(added, d)
+		}
+	}
+	// Durations are kept from the newest build to the oldest one
+	j.history.BuildDurations = append(added, j.history.BuildDurations...)
+}
+
+// ParseTests scans the test results for flakes, merging them into
+// the history of the previously analyzed builds
+func (j *Job) ParseTests(ctx context.Context) error {
+
+	if len(j.builds) == 0 {
+		return fmt.Errorf("%s - No builds to parse", j.Name)
+	}
+
+	slog.Info("Parsing tests", "job", j.Name, "from", j.builds[0].Id, "to", j.builds[len(j.builds)-1].Id)
+
+	tests := j.tests()
+	j.loaded = nil
+	if ds, ok := tests.(diskStore); ok && len(j.history.Builds) == 0 {
+		os.RemoveAll(ds.dir)
+	}
+
+	// Builds artifacts are downloaded in parallel, while the results
+	// must be processed in order
+	type buildResults struct {
+		teardownFailed bool
+		steps          map[string]prow.StepResult
+		stepsErr       error
+		suite          *junit.TestSuite
+		suiteErr       error
+		upgradeEdge    string
+	}
+	results := make([]buildResults, len(j.builds))
+	j.Client.ForEachParallel(len(j.builds), func(i int) {
+		b := j.builds[i]
+		r := &results[i]
+		r.teardownFailed = b.TeardownFailed(ctx)
+		r.steps, r.stepsErr = b.FetchStepResults(ctx)
+		r.suite, r.suiteErr = b.FetchTestsXml(ctx)
+		if j.IsUpgrade() {
+			r.upgradeEdge = b.FetchUpgradeEdge(ctx)
+		}
+	})
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Every test outcome is also recorded as is, for ad-hoc queries
+	outcomes, err := j.openResults()
+	if err != nil {
+		return err
+	}
+	defer outcomes.Close()
+
+	// Counting intermittent failures for all the builds, from the oldest
+	// to the newest one, so that the new builds are appended to the
+	// existing history. A test failing in the newest build is counted
+	// as half a flake, that is withdrawn once a newer build is analyzed
+	newest := make(map[string]*prow.Build)
+	stepDurations := make(map[string][]time.Duration)
+	for i := len(j.builds) - 1; i >= 0; i-- {
+		b := j.builds[i]
+		r := results[i]
+
+		// Leaked hosts are reported regardless of the tests outcome
+		if r.teardownFailed {
+			j.history.TeardownFailures = append(j.history.TeardownFailures, b.Id)
+		}
+
+		if r.stepsErr != nil {
+			slog.Warn("Unable to get the step results", "job", j.Name, "build", b.Id, "err", r.stepsErr)
+		}
+		failedSteps := []string{}
+		for step, sr := range r.steps {
+			if sr.Duration > 0 {
+				stepDurations[step] = append([]time.Duration{sr.Duration}, stepDurations[step]...)
+			}
+			if !sr.Passed {
+				failedSteps = append(failedSteps, step)
+				j.history.StepFailures[step] = append(j.history.StepFailures[step], b.Id)
+			}
+		}
+		sort.Strings(failedSteps)
+
+		// Skip builds without tests, usually because of an earlier step failure
+		if r.suiteErr != nil {
+			if len(failedSteps) > 0 {
+				r.suiteErr = fmt.Errorf("%w, failed steps: %s", r.suiteErr, strings.Join(failedSteps, ", "))
+			}
+			j.skipBuild(b, prow.SkipNoTests, r.suiteErr)
+			continue
+		}
+		delete(j.history.Skipped, b.Id)
+		delete(j.history.SkipCategories, b.Id)
+		if !b.Finished.Passed {
+			j.history.E2eFailures = append(j.history.E2eFailures, b.Id)
+			j.history.FailureStreak++
+		} else {
+			j.history.FailureStreak = 0
+			j.history.LastPassed = b.Finished.Timestamp
+		}
+		if err := outcomes.Write(b, r.suite); err != nil {
+			return err
+		}
+		if err := j.addBuild(tests, b, r.suite, r.upgradeEdge, newest); err != nil {
+			return err
+		}
+	}
+	if err := markPendingFlakes(tests, newest); err != nil {
+		return err
+	}
+
+	// Durations are kept from the newest build to the oldest one
+	for step, d := range stepDurations {
+		j.history.StepDurations[step] = append(d, j.history.StepDurations[step]...)
+	}
+
+	if j.history.From == 0 {
+		j.history.From = j.builds[len(j.builds)-1].Finished.Timestamp
+	}
+	j.history.To = j.builds[0].Finished.Timestamp
+	if newerBuild(j.builds[0].Id, j.history.LastBuild) {
+		j.history.LastBuild = j.builds[0].Id
+	}
+
+	return nil
+}
+
+// addBuild merges the tests outcomes of a build into the history, the
+// builds being added from the oldest one. The tests found in the builds
+// already added by the caller are tracked in newest
+func (j *Job) addBuild(tests testStore, b *prow.Build, suite *junit.TestSuite, edge string, newest map[string]*prow.Build) error {
+	inRunFlakes := suite.CollapseRetries()
+	summary := BuildSummary{Id: b.Id, Timestamp: b.Finished.Timestamp, Passed: b.Finished.Passed, Edge: edge}
+	if edge != "" {
+		j.addUpgradeBuild(b, edge, suite)
+	}
+
+	for _, tc := range suite.TestCases {
+
+		if j.opts.ignoreTest(tc.Name) {
+			continue
+		}
+
+		thc, ok := tests.Get(tc.Name)
+		if !ok {
+			thc = TestHistory{
+				LastState: tc.IsPassed(),
+			}
+		} else if _, seen := newest[tc.Name]; !seen && thc.PendingFlake != "" {
+			thc.Flakes -= 0.5
+			thc.PendingFlake = ""
+		}
+		newest[tc.Name] = b
+
+		if tc.IsPassed() != thc.LastState {
+			thc.addFlake(b)
+		}
+		if inRunFlakes[tc.Name] {
+			thc.InRunFlakeBuilds = append(thc.InRunFlakeBuilds, b.Id)
+		}
+		thc.LastState = tc.IsPassed()
+
+		if !tc.IsSkipped() {
+			thc.Runs++
+			if tc.IsFailure() {
+				summary.FailedTests++
+				thc.addFailure(b, tc.Failure)
+				thc.Failures++
+				thc.Streak++
+				if thc.Streak > thc.MaxStreak {
+					thc.MaxStreak = thc.Streak
+				}
+			} else {
+				thc.Streak = 0
+				thc.Durations = append(thc.Durations, time.Duration(tc.Time*float64(time.Second)))
+			}
+		}
+
+		err := tests.Put(tc.Name, thc)
+		if err != nil {
+			return err
+		}
+	}
+
+	j.history.TotalBuilds += 1.0
+	// Builds are processed from the oldest one
+	j.history.Builds = append([]BuildSummary{summary}, j.history.Builds...)
+	return nil
+}
+
+// markPendingFlakes counts as half a flake the tests failing in the newest
+// of the builds just added, without recording it as a change of state
+func markPendingFlakes(tests testStore, newest map[string]*prow.Build) error {
+	for name, b := range newest {
+		thc, _ := tests.Get(name)
+		if thc.LastState {
+			continue
+		}
+		// Not a change of state, so the build is not recorded among them
+		thc.Flakes += 0.5
+		thc.PendingFlake = b.Id
+		if err := tests.Put(name, thc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prune drops from the history the builds older than the newest
+// RetainBuilds analyzed ones, so that it doesn't grow at every run. The
+// tests history is rebuilt from the retained builds results, as found in
+// the results database. Builds analyzed within a time window are kept
+func (j *Job) prune() error {
+	keep := j.opts.RetainBuilds
+	if keep == 0 {
+		keep = j.opts.NumBuilds
+	}
+	if j.opts.windowed() || len(j.history.Builds) <= keep {
+		return nil
+	}
+
+	retained := append([]BuildSummary{}, j.history.Builds[:keep]...)
+	oldest := retained[len(retained)-1]
+	if err := j.rebuildTests(retained); err != nil {
+		return err
+	}
+	slog.Info("Pruning the older builds", "job", j.Name, "oldest", oldest.Id)
+
+	// The other builds are pruned according to their id, since the
+	// install failures and the skipped ones are not among the analyzed
+	kept := func(id string) bool {
+		return !newerBuild(oldest.Id, id)
+	}
+	keepIds := func(ids []string) []string {
+		filtered := []string{}
+		for _, id := range ids {
+			if kept(id) {
+				filtered = append(filtered, id)
+			}
+		}
+		return filtered
+	}
+
+	h := &j.history
+	h.TeardownFailures = keepIds(h.TeardownFailures)
+	h.E2eFailures = keepIds(h.E2eFailures)
+	h.UnclassifiedFailures = keepIds(h.UnclassifiedFailures)
+	installFailures := []prow.InstallFailure{}
+	for _, f := range h.InstallFailures {
+		if kept(f.Build) {
+			installFailures = append(installFailures, f)
+		}
+	}
+	h.InstallFailures = installFailures
+	durations := []BuildDuration{}
+	for _, d := range h.BuildDurations {
+		if kept(d.Build) {
+			durations = append(durations, d)
+		}
+	}
+	h.BuildDurations = durations
+	for _, ids := range []map[string][]string{h.StepFailures, h.FailureLabels} {
+		for k, v := range ids {
+			if v = keepIds(v); len(v) > 0 {
+				ids[k] = v
+			} else {
+				delete(ids, k)
+			}
+		}
+	}
+	for k, pe := range h.ProvisioningErrors {
+		if pe.Builds = keepIds(pe.Builds); len(pe.Builds) > 0 {
+			h.ProvisioningErrors[k] = pe
+		} else {
+			delete(h.ProvisioningErrors, k)
+		}
+	}
+	for _, ids := range []map[string]string{h.Skipped, h.SkipCategories, j.BuildPaths} {
+		for id := range ids {
+			if !kept(id) {
+				delete(ids, id)
+			}
+		}
+	}
+	// Step durations are not tracked by build, but are recorded for the
+	// skipped builds too, from the newest one
+	for step, d := range h.StepDurations {
+		if n := len(retained) + len(h.Skipped); len(d) > n {
+			h.StepDurations[step] = d[:n]
+		}
+	}
+
+	h.From = oldest.Timestamp
+
+	return nil
+}
+
+// rebuildTests rebuilds from scratch the tests history and the upgrade
+// edges of the given analyzed builds, from the newest to the oldest one,
+// out of their results as found in the results database
+func (j *Job) rebuildTests(builds []BuildSummary) error {
+	suites := make(map[string]*junit.TestSuite)
+	if len(builds) > 0 {
+		var err error
+		if suites, err = j.readResults(builds[len(builds)-1].Timestamp); err != nil {
+			return err
+		}
+	}
+	for _, bs := range builds {
+		if _, ok := suites[bs.Id]; !ok {
+			return fmt.Errorf("no results recorded for build %s", bs.Id)
+		}
+	}
+
+	if ds, ok := j.tests().(diskStore); ok {
+		os.RemoveAll(ds.dir)
+	}
+	h := &j.history
+	h.Data = make(map[string]TestHistory)
+	h.UpgradeEdges = make(map[string]UpgradeEdge)
+	h.Builds = nil
+	h.TotalBuilds = 0
+	j.loaded = nil
+
+	tests := j.tests()
+	newest := make(map[string]*prow.Build)
+	for i := len(builds) - 1; i >= 0; i-- {
+		bs := builds[i]
+		b := prow.NewBuild(bs.Id, j.Job)
+		b.Finished = prow.Finished{Timestamp: bs.Timestamp, Passed: bs.Passed}
+		if err := j.addBuild(tests, b, suites[bs.Id], bs.Edge, newest); err != nil {
+			return err
+		}
+	}
+	return markPendingFlakes(tests, newest)
+}
+
+// classifyFailures labels the given failed builds, from the newest one,
+// with the known failure signatures found in their logs
+func (j *Job) classifyFailures(ctx context.Context, ids []string) {
+	if len(j.opts.FailureRules) == 0 || len(ids) == 0 {
+		return
+	}
+
+	labels := make([][]string, len(ids))
+	errs := make([]error, len(ids))
+	j.Client.ForEachParallel(len(ids), func(i int) {
+		labels[i], errs[i] = prow.NewBuild(ids[i], j.Job).MatchFailureRules(ctx, j.opts.FailureRules)
+	})
+	if ctx.Err() != nil {
+		return
+	}
+
+	// New builds are prepended, in the same order
+	for i := len(ids) - 1; i >= 0; i-- {
+		if errs[i] != nil {
+			slog.Warn("Unable to classify the failure", "job", j.Name, "build", ids[i], "err", errs[i])
+			continue
+		}
+		if len(labels[i]) == 0 {
+			j.history.UnclassifiedFailures = append([]string{ids[i]}, j.history.UnclassifiedFailures...)
+		}
+		for _, label := range labels[i] {
+			j.history.FailureLabels[label] = append([]string{ids[i]}, j.history.FailureLabels[label]...)
+		}
+	}
+}
+
+// analyzeProvisioning records the provisioning errors logged by the metal3
+// pods of the given failed builds, from the newest one
+func (j *Job) analyzeProvisioning(ctx context.Context, ids []string) {
+	if !j.opts.Metal3Logs || len(ids) == 0 {
+		return
+	}
+
+	found := make([]map[string]string, len(ids))
+	errs := make([]error, len(ids))
+	j.Client.ForEachParallel(len(ids), func(i int) {
+		found[i], errs[i] = prow.NewBuild(ids[i], j.Job).FetchProvisioningErrors(ctx)
+	})
+	if ctx.Err() != nil {
+		return
+	}
+
+	// New builds are prepended, in the same order
+	for i := len(ids) - 1; i >= 0; i-- {
+		if errs[i] != nil {
+			slog.Warn("Unable to read the metal3 logs", "job", j.Name, "build", ids[i], "err", errs[i])
+			continue
+		}
+		for category, message := range found[i] {
+			pe := j.history.ProvisioningErrors[category]
+			pe.Builds = append([]string{ids[i]}, pe.Builds...)
+			pe.Example = message
+			j.history.ProvisioningErrors[category] = pe
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package flakes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andfasano/metal-ipi-releases/internal/gcs"
+	"github.com/andfasano/metal-ipi-releases/internal/prow"
+)
+
+const fixtureJob = "periodic-ci-openshift-release-master-nightly-4.10-e2e-metal-ipi"
+
+// gcsFixtures serves the artifacts found in the testdata/gcs folder, laid
+// out like the origin-ci-test bucket, answering both the gcsweb downloads
+// and the GCS JSON API listings
+type gcsFixtures struct {
+	root string
+}
+
+func (f gcsFixtures) Do(req *http.Request) (*http.Response, error) {
+	u := req.URL.String()
+	switch {
+	case strings.HasPrefix(u, gcs.ListUrl):
+		prefix := req.URL.Query().Get("prefix")
+		listing := gcs.Listing{}
+		entries, _ := ioutil.ReadDir(filepath.Join(f.root, prefix))
+		for _, e := range entries {
+			if e.IsDir() {
+				listing.Prefixes = append(listing.Prefixes, path.Join(prefix, e.Name())+"/")
+			} else {
+				listing.Items = append(listing.Items, struct {
+					Name string `json:"name"`
+				}{path.Join(prefix, e.Name())})
+			}
+		}
+		data, err := json.Marshal(listing)
+		if err != nil {
+			return nil, err
+		}
+		return fixtureResponse(req, http.StatusOK, ioutil.NopCloser(strings.NewReader(string(data)))), nil
+
+	case strings.HasPrefix(u, gcs.BucketUrl(gcs.BaseUrl, "")):
+		body, err := os.Open(filepath.Join(f.root, strings.TrimPrefix(u, gcs.BucketUrl(gcs.BaseUrl, ""))))
+		if os.IsNotExist(err) {
+			return fixtureResponse(req, http.StatusNotFound, ioutil.NopCloser(strings.NewReader(""))), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return fixtureResponse(req, http.StatusOK, body), nil
+	}
+	return nil, errors.New("unexpected request " + u)
+}
+
+func fixtureResponse(req *http.Request, code int, body io.ReadCloser) *http.Response {
+	return &http.Response{
+		Status:     http.StatusText(code),
+		StatusCode: code,
+		Header:     http.Header{},
+		Body:       body,
+		Request:    req,
+	}
+}
+
+// useFixtures returns the default options, serving the requests from
+// testdata/gcs and caching the downloads and the results in a temporary folder
+func useFixtures(t *testing.T) *Options {
+	opts := DefaultOptions(t.TempDir())
+	opts.Client.Fetcher = gcsFixtures{root: filepath.Join("testdata", "gcs")}
+	return opts
+}
+
+// parseFixtureJob analyzes the builds of the fixture job, from 105 (the
+// newest one, without tests) to 100
+func parseFixtureJob(t *testing.T) *Job {
+	return parseFixtureBuilds(t, 100)
+}
+
+// parseFixtureBuilds analyzes the builds of the fixture job from 105 to
+// the given one
+func parseFixtureBuilds(t *testing.T, oldest int) *Job {
+	j := NewJob(fixtureJob, useFixtures(t))
+	for id := 105; id >= oldest; id-- {
+		b := prow.NewBuild(strconv.Itoa(id), j.Job)
+		b.Finished = prow.Finished{Timestamp: 1633089600 + int64(id-100)*86400, Passed: false, Result: "FAILURE"}
+		j.builds = append(j.builds, b)
+	}
+	if err := j.ParseTests(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestParseTests(t *testing.T) {
+	j := parseFixtureJob(t)
+
+	if j.history.TotalBuilds != 5 {
+		t.Errorf("expected 5 builds, got %v", j.history.TotalBuilds)
+	}
+	if j.history.LastBuild != "105" {
+		t.Errorf("expected 105 as last build, got %s", j.history.LastBuild)
+	}
+	if j.history.SkipCategories["105"] != prow.SkipNoTests {
+		t.Errorf("expected 105 skipped as %s, got %q", prow.SkipNoTests, j.history.SkipCategories["105"])
+	}
+	if !strings.Contains(j.history.Skipped["105"], "baremetalds-devscripts-setup") {
+		t.Errorf("expected the failed steps in the skip reason, got %q", j.history.Skipped["105"])
+	}
+	if !reflect.DeepEqual(j.history.TeardownFailures, []string{"104"}) {
+		t.Errorf("expected teardown failures [104], got %v", j.history.TeardownFailures)
+	}
+
+	tests := []struct {
+		name         string
+		flakes       float32
+		runs         int
+		failures     int
+		builds       []string
+		failedBuilds []string
+		inRunFlakes  []string
+		failureModes int
+	}{
+		{
+			name:         "[sig-network] Services should serve endpoints",
+			flakes:       2,
+			runs:         5,
+			failures:     2,
+			builds:       []string{"101", "102", "103", "104"},
+			failedBuilds: []string{"101", "103"},
+			failureModes: 1,
+		},
+		{
+			name: "[sig-storage] Volumes should be mountable",
+			runs: 5,
+		},
+		{
+			// Always failing, so only the newest failure is pending
+			name:         "[sig-node] Pods should be evicted",
+			flakes:       0.5,
+			runs:         5,
+			failures:     5,
+			failedBuilds: []string{"100", "101", "102", "103", "104"},
+			failureModes: 1,
+		},
+		{
+			// Retried within 102, passing at the second attempt
+			name:        "[sig-apps] Deployment should roll out",
+			runs:        5,
+			inRunFlakes: []string{"102"},
+		},
+		{
+			name: "[sig-cli] Kubectl should describe pods",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th, ok := j.tests().Get(tt.name)
+			if !ok {
+				t.Fatal("test not found")
+			}
+			if th.Flakes != tt.flakes {
+				t.Errorf("expected %v flakes, got %v", tt.flakes, th.Flakes)
+			}
+			if th.Runs != tt.runs || th.Failures != tt.failures {
+				t.Errorf("expected %d/%d failures, got %d/%d", tt.failures, tt.runs, th.Failures, th.Runs)
+			}
+			if !reflect.DeepEqual(th.Builds, tt.builds) {
+				t.Errorf("expected changes of state in %v, got %v", tt.builds, th.Builds)
+			}
+			if !reflect.DeepEqual(th.FailedBuilds, tt.failedBuilds) {
+				t.Errorf("expected failures in %v, got %v", tt.failedBuilds, th.FailedBuilds)
+			}
+			if !reflect.DeepEqual(th.InRunFlakeBuilds, tt.inRunFlakes) {
+				t.Errorf("expected in-run flakes in %v, got %v", tt.inRunFlakes, th.InRunFlakeBuilds)
+			}
+			if len(th.FailureModes) != tt.failureModes {
+				t.Errorf("expected %d failure modes, got %v", tt.failureModes, th.FailureModes)
+			}
+		})
+	}
+
+	if _, ok := j.tests().Get("[sig-arch] Monitor cluster while tests execute"); ok {
+		t.Error("expected the ignored test not to be analyzed")
+	}
+}
+
+func TestFailureSignature(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		expected string
+	}{
+		{
+			name:     "first line only",
+			message:  "\n  fail [service.go:1023]: timed out\nstack trace",
+			expected: "fail [service.go:<n>]: timed out",
+		},
+		{
+			name:     "uuid",
+			message:  "pod 3f2c1a9e-1111-2222-3333-444444444444 not ready",
+			expected: "pod <uuid> not ready",
+		},
+		{
+			name:     "timestamps",
+			message:  "expired at 2021-10-01T12:00:01.123Z, retried at 12:00:05",
+			expected: "expired at <time>, retried at <time>",
+		},
+		{
+			name:     "ip and port",
+			message:  "dial tcp 192.168.111.5:6443: connection refused",
+			expected: "dial tcp <ip>: connection refused",
+		},
+		{
+			name:     "generated names",
+			message:  "pod e2e-test-abc12 in namespace e2e-4821 failed",
+			expected: "pod <id>-test-<id> in namespace <id>-<n> failed",
+		},
+		{
+			name:     "truncated",
+			message:  strings.Repeat("a", 300),
+			expected: strings.Repeat("a", 200),
+		},
+		{
+			name:     "empty",
+			message:  "\n\n",
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failureSignature(tt.message); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestListBuilds(t *testing.T) {
+	tests := []struct {
+		name      string
+		numBuilds int
+		lastBuild string
+		selected  []string
+		durations int
+	}{
+		{
+			name:      "all builds",
+			numBuilds: 10,
+			selected:  []string{"104", "103", "102", "101", "100"},
+			durations: 6,
+		},
+		{
+			name:      "newest builds",
+			numBuilds: 2,
+			selected:  []string{"104", "103"},
+			durations: 3,
+		},
+		{
+			name:      "newer than the analyzed ones",
+			numBuilds: 10,
+			lastBuild: "102",
+			selected:  []string{"104", "103"},
+			durations: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := NewJob(fixtureJob, useFixtures(t))
+			j.history.LastBuild = tt.lastBuild
+
+			// The second run finds no new builds, the install failure of
+			// the newest one included
+			for run, selected := range [][]string{tt.selected, {}} {
+				if err := j.ListBuilds(context.Background(), tt.numBuilds); err != nil {
+					t.Fatal(err)
+				}
+				ids := []string{}
+				for _, b := range j.builds {
+					ids = append(ids, b.Id)
+				}
+				if !reflect.DeepEqual(ids, selected) {
+					t.Errorf("run %d: expected builds %v, got %v", run, selected, ids)
+				}
+				if j.history.LastBuild != "105" {
+					t.Errorf("run %d: expected 105 as last build, got %s", run, j.history.LastBuild)
+				}
+				if len(j.history.InstallFailures) != 1 || j.history.InstallFailures[0].Build != "105" {
+					t.Errorf("run %d: expected the install failure of 105, got %v", run, j.history.InstallFailures)
+				}
+				if len(j.history.BuildDurations) != tt.durations {
+					t.Errorf("run %d: expected %d durations, got %v", run, tt.durations, j.history.BuildDurations)
+				}
+				if j.history.BuildDurations[0] != (BuildDuration{Build: "105", Duration: 3 * time.Hour}) {
+					t.Errorf("run %d: expected the duration of 105 first, got %v", run, j.history.BuildDurations[0])
+				}
+			}
+		})
+	}
+}
+
+func TestParseTestsKeepsLastBuild(t *testing.T) {
+	j := NewJob(fixtureJob, useFixtures(t))
+	j.history.LastBuild = "105"
+	b := prow.NewBuild("104", j.Job)
+	b.Finished = prow.Finished{Timestamp: 1633435200}
+	j.builds = []*prow.Build{b}
+
+	if err := j.ParseTests(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if j.history.LastBuild != "105" {
+		t.Errorf("expected 105 as last build, got %s", j.history.LastBuild)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name     string
+		retain   int
+		oldest   int
+		expected int
+	}{
+		{name: "older builds pruned", retain: 3, oldest: 102, expected: 3},
+		{name: "newest build only", retain: 1, oldest: 104, expected: 1},
+		{name: "nothing to prune", retain: 5, oldest: 100, expected: 5},
+		{name: "more than analyzed", retain: 10, oldest: 100, expected: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pruned := parseFixtureJob(t)
+			pruned.opts.RetainBuilds = tt.retain
+			if err := pruned.prune(); err != nil {
+				t.Fatal(err)
+			}
+			// The same as analyzing only the retained builds
+			fresh := parseFixtureBuilds(t, tt.oldest)
+
+			if pruned.history.TotalBuilds != float32(tt.expected) {
+				t.Errorf("expected %d builds, got %v", tt.expected, pruned.history.TotalBuilds)
+			}
+			if !reflect.DeepEqual(pruned.history.Data, fresh.history.Data) {
+				t.Errorf("expected the tests history\n%+v\ngot\n%+v", fresh.history.Data, pruned.history.Data)
+			}
+			if !reflect.DeepEqual(pruned.history.Builds, fresh.history.Builds) {
+				t.Errorf("expected the builds %+v, got %+v", fresh.history.Builds, pruned.history.Builds)
+			}
+			if !reflect.DeepEqual(pruned.history.TeardownFailures, fresh.history.TeardownFailures) {
+				t.Errorf("expected teardown failures %v, got %v", fresh.history.TeardownFailures, pruned.history.TeardownFailures)
+			}
+			if pruned.history.From != fresh.history.From || pruned.history.LastBuild != fresh.history.LastBuild {
+				t.Errorf("expected from %d to %s, got from %d to %s", fresh.history.From, fresh.history.LastBuild, pruned.history.From, pruned.history.LastBuild)
+			}
+		})
+	}
+}
@@ -0,0 +1,614 @@
+package flakes
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/andfasano/metal-ipi-releases/internal/gcs"
+	"github.com/andfasano/metal-ipi-releases/internal/release"
+)
+
+// slackWebhook is a Slack incoming webhook notified about the jobs
+// matching a pattern
+type slackWebhook struct {
+	pattern *regexp.Regexp
+	url     string
+}
+
+// ParseSlackWebhooks reads the webhooks, given as <job regex>=<webhook url>
+func ParseSlackWebhooks(values []string) ([]slackWebhook, error) {
+	webhooks := []slackWebhook{}
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "http") {
+			return nil, fmt.Errorf("Invalid Slack webhook %s, expected <job regex>=<webhook url>", v)
+		}
+		re, err := regexp.Compile(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Slack webhook %s: %w", v, err)
+		}
+		webhooks = append(webhooks, slackWebhook{pattern: re, url: parts[1]})
+	}
+	return webhooks, nil
+}
+
+// Slack notifies the jobs with new builds to the webhooks matching them
+type Slack struct {
+	Webhooks []slackWebhook
+	// How many flaky tests are reported for every job
+	Top     int
+	Fetcher gcs.Fetcher
+}
+
+// slackSummary describes the outcome of the job newest builds: whether the
+// newest one passed, the top flaky tests and the ones flaking for the first
+// time in the builds analyzed by the current run, followed by the given
+// status of the release payloads
+func (j *Job) slackSummary(payload string, top int) string {
+	newest := j.builds[0]
+	oldest := j.builds[len(j.builds)-1]
+
+	status := "passed"
+	if !newest.Finished.Passed {
+		status = "failed"
+	}
+
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "*<%s|%s>*: %d new builds, the newest one <%s|%s> %s\n", j.HistoryUrl(), j.Name, len(j.builds), j.BuildUrl(newest.Id), newest.Id, status)
+
+	// On the first run all the flaky tests would be new ones
+	flakes := j.flakyTests()
+	newFlakes := []FlakyTest{}
+	for _, f := range flakes {
+		if oldest.Finished.Timestamp > j.history.From && f.firstSeen >= oldest.Finished.Timestamp {
+			newFlakes = append(newFlakes, f)
+		}
+	}
+
+	if len(flakes) > top {
+		flakes = flakes[:top]
+	}
+	if len(flakes) > 0 {
+		fmt.Fprintf(&sb, "Top flaky tests:\n")
+		for _, f := range flakes {
+			fmt.Fprintf(&sb, "• %.2f `%s` (failed %d/%d runs)\n", f.flakiness, f.name, f.failures, f.runs)
+		}
+	}
+	if len(newFlakes) > 0 {
+		fmt.Fprintf(&sb, "New flaky tests:\n")
+		for _, f := range newFlakes {
+			fmt.Fprintf(&sb, "• `%s`\n", f.name)
+		}
+	}
+	if failing := j.permafailingTests(); len(failing) > 0 {
+		fmt.Fprintf(&sb, "%d consistently failing tests\n", len(failing))
+	}
+	sb.WriteString(payload)
+
+	return sb.String()
+}
+
+// payloadSummary describes whether the newest payload of a version was
+// accepted or rejected and, when not accepted, which one was the last
+// accepted payload
+func payloadSummary(ctx context.Context, rc *release.ReleaseController, rs release.Stream, version string) string {
+	newest, err := rc.NewestPayload(ctx, rs, version)
+	if err != nil {
+		slog.Warn("Unable to get the newest payload", "version", version, "err", err)
+		return ""
+	}
+
+	summary := fmt.Sprintf("Newest %s payload %s: %s", version, newest.Name, newest.Phase)
+	if newest.Phase != "Accepted" {
+		if name, built, err := rc.LastAccepted(ctx, rs, version); err == nil {
+			summary += fmt.Sprintf(", last accepted %s (%s ago)", name, time.Since(built).Round(time.Hour))
+		}
+	}
+	return summary + "\n"
+}
+
+// notificationKey identifies the results reported by the notifications,
+// that is the newest build outcome and the flaky and failing tests
+func (j *Job) notificationKey() string {
+	key := []string{fmt.Sprint(j.builds[0].Finished.Passed)}
+	for _, f := range j.flakyTests() {
+		key = append(key, "flaky "+f.name)
+	}
+	for _, f := range j.permafailingTests() {
+		key = append(key, "failing "+f.name)
+	}
+	return strings.Join(key, "\n")
+}
+
+// Notify posts the summary of the jobs with new builds to the webhooks
+// configured for them, one message per webhook. The jobs whose results
+// did not change since they were last notified are skipped, and the ones
+// not accepted by any of their webhooks are notified again later
+func (s *Slack) Notify(ctx context.Context, jobs []*Job, rc *release.ReleaseController, rs release.Stream, notified map[string]string) {
+	if len(s.Webhooks) == 0 {
+		return
+	}
+
+	changed := []*Job{}
+	keys := make(map[string]string)
+	for _, j := range jobs {
+		if len(j.builds) == 0 {
+			continue
+		}
+		key := j.notificationKey()
+		if last, ok := notified[j.Name]; ok && last == key {
+			continue
+		}
+		keys[j.Name] = key
+		changed = append(changed, j)
+	}
+
+	// The payloads status is fetched once per version
+	payloads := make(map[string]string)
+	payloadOf := func(j *Job) string {
+		version, _, ok := rs.SplitJobName(j.Name)
+		if !ok {
+			return ""
+		}
+		if _, ok := payloads[version]; !ok {
+			payloads[version] = payloadSummary(ctx, rc, rs, version)
+		}
+		return payloads[version]
+	}
+
+	failed := make(map[string]bool)
+	for _, w := range s.Webhooks {
+		summaries := []string{}
+		matched := []*Job{}
+		for _, j := range changed {
+			if w.pattern.MatchString(j.Name) {
+				summaries = append(summaries, j.slackSummary(payloadOf(j), s.Top))
+				matched = append(matched, j)
+			}
+		}
+		if len(summaries) == 0 {
+			continue
+		}
+
+		if err := s.post(ctx, w.url, strings.Join(summaries, "\n")); err != nil {
+			slog.Error("Unable to notify Slack", "err", err)
+			for _, j := range matched {
+				failed[j.Name] = true
+			}
+		}
+	}
+
+	for _, j := range changed {
+		if !failed[j.Name] {
+			notified[j.Name] = keys[j.Name]
+		}
+	}
+}
+
+// post sends a message to a Slack incoming webhook
+func (s *Slack) post(ctx context.Context, webhookUrl string, text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.Fetcher.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Not using the webhook url, since it is a secret
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// GithubIssue is an issue tracking a flaky test
+type GithubIssue struct {
+	Number int    `json:"number"`
+	Title  string `json:"title"`
+	Url    string `json:"html_url"`
+}
+
+// Github looks up the issues tracking the flaky tests, optionally filing
+// new ones for the untracked tests
+type Github struct {
+	ApiUrl string
+	Token  string
+	// The repository of the issues, as org/repo
+	Repo       string
+	FileIssues bool
+	Fetcher    gcs.Fetcher
+	// Keeps the issues searches within the GitHub search API rate limit
+	SearchLimiter *gcs.RateLimiter
+}
+
+// NewGithub returns the client of the given GitHub API, keeping the
+// issues searches within its rate limit, i.e. 30 requests per minute
+func NewGithub(apiUrl string, fetcher gcs.Fetcher) *Github {
+	return &Github{
+		ApiUrl:        apiUrl,
+		Fetcher:       fetcher,
+		SearchLimiter: gcs.NewRateLimiter(0.5),
+	}
+}
+
+// Api sends a request to the GitHub REST API, decoding the reply
+func (gh *Github) Api(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	url := gh.ApiUrl + path
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if gh.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+gh.Token)
+	}
+
+	resp, err := gh.Fetcher.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return &gcs.HttpStatusError{Url: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+var testTagsRe = regexp.MustCompile(`\[[^\]]*\]`)
+
+// issueSearchText returns the part of a test name used to look for the
+// issues about it: the sig and suite tags are dropped, and the text is
+// shortened to stay within the search query limits
+func issueSearchText(test string) string {
+	text := strings.ReplaceAll(testTagsRe.ReplaceAllString(test, " "), `"`, " ")
+	text = strings.Join(strings.Fields(text), " ")
+	for len(text) > 100 && strings.Contains(text, " ") {
+		text = text[:strings.LastIndex(text, " ")]
+	}
+	return text
+}
+
+// findIssue looks for an open issue with the test name in its title
+func (gh *Github) findIssue(ctx context.Context, test string) (*GithubIssue, error) {
+	if err := gh.SearchLimiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("q", fmt.Sprintf(`repo:%s is:issue is:open in:title "%s"`, gh.Repo, issueSearchText(test)))
+	result := struct {
+		Items []GithubIssue `json:"items"`
+	}{}
+	if err := gh.Api(ctx, http.MethodGet, "/search/issues?"+query.Encode(), nil, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Items) == 0 {
+		return nil, nil
+	}
+	return &result.Items[0], nil
+}
+
+// DefaultIssueTemplate is the body of the issues filed for the flaky tests
+const DefaultIssueTemplate = `The test {{.Test}} is flaky in [{{.Job}}]({{.HistoryUrl}}): it failed {{.Failures}} times in {{.Runs}} runs, with a flakiness of {{printf "%.2f" .Flakiness}}.
+
+Failed in:
+{{range .FailedBuilds}}- [{{.Id}}]({{.Url}}) ([artifacts]({{.ArtifactsUrl}}))
+{{end}}{{if .FailureModes}}
+Failure modes:
+{{range .FailureModes}}- {{.Count}}x ` + "`{{.Signature}}`" + `
+{{end}}{{end}}`
+
+// fileIssue opens an issue for a flaky test, using the issue template
+func (j *Job) fileIssue(ctx context.Context, gh *Github, tmpl *texttemplate.Template, f FlakyTest) (*GithubIssue, error) {
+	body := strings.Builder{}
+	err := tmpl.Execute(&body, map[string]interface{}{
+		"Job":          j.Name,
+		"HistoryUrl":   j.HistoryUrl(),
+		"Test":         f.name,
+		"Flakiness":    f.flakiness,
+		"Failures":     f.failures,
+		"Runs":         f.runs,
+		"FailedBuilds": j.buildLinks(f.failedBuilds),
+		"FailureModes": f.modes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	issue := &GithubIssue{}
+	request := map[string]string{
+		"title": fmt.Sprintf("Flaky test: %s", f.name),
+		"body":  body.String(),
+	}
+	if err := gh.Api(ctx, http.MethodPost, fmt.Sprintf("/repos/%s/issues", gh.Repo), request, issue); err != nil {
+		return nil, err
+	}
+	return issue, nil
+}
+
+// FetchSippy retrieves the Sippy pass rates of the flaky tests of the job
+func (j *Job) FetchSippy(ctx context.Context, sippy *release.Sippy) {
+	if j.Version == "" {
+		return
+	}
+
+	j.sippy = make(map[string]*release.SippySummary)
+	for _, f := range j.flakyTests() {
+		summary, err := sippy.Summary(ctx, j.Version, f.name)
+		if err != nil {
+			slog.Warn("Unable to get the Sippy pass rate", "job", j.Name, "test", f.name, "err", err)
+			continue
+		}
+		if summary != nil {
+			j.sippy[f.name] = summary
+		}
+	}
+}
+
+// CorrelateIssues looks for the issues tracking the flaky tests of the job,
+// optionally filing new ones for the untracked tests
+func (j *Job) CorrelateIssues(ctx context.Context, gh *Github, tmpl *texttemplate.Template) {
+	j.issues = make(map[string]*GithubIssue)
+	j.issuesRepo = gh.Repo
+	for _, f := range j.flakyTests() {
+		issue, err := gh.findIssue(ctx, f.name)
+		if err != nil {
+			slog.Warn("Unable to look for the issues", "job", j.Name, "test", f.name, "err", err)
+			continue
+		}
+		if issue == nil && gh.FileIssues {
+			issue, err = j.fileIssue(ctx, gh, tmpl, f)
+			if err != nil {
+				slog.Warn("Unable to file an issue", "job", j.Name, "test", f.name, "err", err)
+				continue
+			}
+			slog.Info("Filed an issue", "job", j.Name, "url", issue.Url)
+		}
+		j.issues[f.name] = issue
+	}
+}
+
+// issueStatus tells whether the test is tracked by an issue
+func (j *Job) issueStatus(f FlakyTest) string {
+	if f.issue == nil {
+		return "UNTRACKED"
+	}
+	return fmt.Sprintf("tracked in %s#%d", j.issuesRepo, f.issue.Number)
+}
+
+// JiraBug is a Jira bug matching a flaky test
+type JiraBug struct {
+	Key     string `json:"key"`
+	Summary string `json:"summary"`
+	Status  string `json:"status"`
+	Url     string `json:"url"`
+}
+
+// jqlPhrase quotes a text to be searched as a phrase in a JQL query,
+// dropping the characters with a special meaning for the text search
+func jqlPhrase(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`"'\+-&|!(){}[]^~*?:/`, r) {
+			return ' '
+		}
+		return r
+	}, text)
+	text = strings.Join(strings.Fields(text), " ")
+	for len(text) > 80 && strings.Contains(text, " ") {
+		text = text[:strings.LastIndex(text, " ")]
+	}
+	return `"\"` + text + `\""`
+}
+
+// Jira looks up the bugs matching the top flaky tests
+type Jira struct {
+	Url     string
+	Project string
+	Token   string
+	// How many flaky tests are looked up for every job
+	Top     int
+	Fetcher gcs.Fetcher
+}
+
+// searchBugs looks for the bugs mentioning the test name in their summary,
+// or the test failure message anywhere, from the most recently updated
+func (jira *Jira) searchBugs(ctx context.Context, f FlakyTest) ([]JiraBug, error) {
+	jql := fmt.Sprintf("project = %s AND (summary ~ %s", jira.Project, jqlPhrase(issueSearchText(f.name)))
+	if len(f.modes) > 0 {
+		message := strings.SplitN(f.modes[0].Example, "\n", 2)[0]
+		jql += fmt.Sprintf(" OR text ~ %s", jqlPhrase(message))
+	}
+	jql += ") ORDER BY updated DESC"
+
+	query := url.Values{}
+	query.Set("jql", jql)
+	query.Set("fields", "summary,status")
+	query.Set("maxResults", "5")
+	url := fmt.Sprintf("%s/rest/api/2/search?%s", jira.Url, query.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if jira.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+jira.Token)
+	}
+	resp, err := jira.Fetcher.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &gcs.HttpStatusError{Url: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	result := struct {
+		Issues []struct {
+			Key    string `json:"key"`
+			Fields struct {
+				Summary string `json:"summary"`
+				Status  struct {
+					Name string `json:"name"`
+				} `json:"status"`
+			} `json:"fields"`
+		} `json:"issues"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	bugs := []JiraBug{}
+	for _, i := range result.Issues {
+		bugs = append(bugs, JiraBug{
+			Key:     i.Key,
+			Summary: i.Fields.Summary,
+			Status:  i.Fields.Status.Name,
+			Url:     fmt.Sprintf("%s/browse/%s", jira.Url, i.Key),
+		})
+	}
+	return bugs, nil
+}
+
+// LookupBugs searches the Jira bugs matching the top flaky tests of the job
+func (j *Job) LookupBugs(ctx context.Context, jira *Jira) {
+	j.bugs = make(map[string][]JiraBug)
+	flakes := j.flakyTests()
+	if len(flakes) > jira.Top {
+		flakes = flakes[:jira.Top]
+	}
+	for _, f := range flakes {
+		bugs, err := jira.searchBugs(ctx, f)
+		if err != nil {
+			slog.Warn("Unable to look for the bugs", "job", j.Name, "test", f.name, "err", err)
+			continue
+		}
+		j.bugs[f.name] = bugs
+	}
+}
+
+// WriteMetrics prints the jobs health in the Prometheus text format,
+// together with the age of the newest accepted payload of every version.
+// The Prow jobs are labelled as prow_job, since job is the target label
+// set by Prometheus when scraping, and the grouping key of the Pushgateway
+func WriteMetrics(ctx context.Context, w io.Writer, jobs []*Job, rc *release.ReleaseController, rs release.Stream, versions []string) error {
+	label := func(s string) string {
+		return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+	}
+
+	bw := bufio.NewWriter(w)
+	gauge := func(name, help string, samples func()) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		samples()
+	}
+
+	gauge("metal_ipi_job_builds_analyzed", "Number of builds analyzed for the job", func() {
+		for _, j := range jobs {
+			fmt.Fprintf(bw, "metal_ipi_job_builds_analyzed{prow_job=\"%s\"} %d\n", j.Name, j.analyzedBuilds())
+		}
+	})
+	gauge("metal_ipi_job_pass_rate", "Ratio of the analyzed builds that passed, failed installations included", func() {
+		for _, j := range jobs {
+			if n := j.analyzedBuilds(); n > 0 {
+				passed := n - len(j.history.InstallFailures) - len(j.history.E2eFailures)
+				fmt.Fprintf(bw, "metal_ipi_job_pass_rate{prow_job=\"%s\"} %g\n", j.Name, float64(passed)/float64(n))
+			}
+		}
+	})
+	gauge("metal_ipi_job_consecutive_failures", "Number of the newest builds with tests that failed in a row", func() {
+		for _, j := range jobs {
+			fmt.Fprintf(bw, "metal_ipi_job_consecutive_failures{prow_job=\"%s\"} %d\n", j.Name, j.history.FailureStreak)
+		}
+	})
+	gauge("metal_ipi_job_last_passed_timestamp_seconds", "When the newest passing build finished", func() {
+		for _, j := range jobs {
+			if j.history.LastPassed > 0 {
+				fmt.Fprintf(bw, "metal_ipi_job_last_passed_timestamp_seconds{prow_job=\"%s\"} %d\n", j.Name, j.history.LastPassed)
+			}
+		}
+	})
+	gauge("metal_ipi_job_flaky_tests", "Number of flaky tests", func() {
+		for _, j := range jobs {
+			fmt.Fprintf(bw, "metal_ipi_job_flaky_tests{prow_job=\"%s\"} %d\n", j.Name, len(j.flakyTests()))
+		}
+	})
+	gauge("metal_ipi_job_permafailing_tests", "Number of consistently failing tests", func() {
+		for _, j := range jobs {
+			fmt.Fprintf(bw, "metal_ipi_job_permafailing_tests{prow_job=\"%s\"} %d\n", j.Name, len(j.permafailingTests()))
+		}
+	})
+	gauge("metal_ipi_test_flakiness", "Flakiness of the flaky tests, between 0 and 1", func() {
+		for _, j := range jobs {
+			for _, f := range j.flakyTests() {
+				fmt.Fprintf(bw, "metal_ipi_test_flakiness{prow_job=\"%s\",test=\"%s\"} %g\n", j.Name, label(f.name), f.flakiness)
+			}
+		}
+	})
+	gauge("metal_ipi_release_last_accepted_age_seconds", "Age of the newest accepted payload of the release", func() {
+		for _, v := range versions {
+			name, built, err := rc.LastAccepted(ctx, rs, v)
+			if err != nil {
+				slog.Warn("Unable to get the last accepted payload", "version", v, "err", err)
+				continue
+			}
+			fmt.Fprintf(bw, "metal_ipi_release_last_accepted_age_seconds{version=\"%s\",payload=\"%s\"} %.0f\n", v, name, time.Since(built).Seconds())
+		}
+	})
+
+	return bw.Flush()
+}
+
+// analyzedBuilds returns how many builds were analyzed for the job,
+// the ones where the installation failed included
+func (j *Job) analyzedBuilds() int {
+	return int(j.history.TotalBuilds) + len(j.history.InstallFailures)
+}
+
+// PushMetrics sends the metrics to a Prometheus Pushgateway, replacing
+// the ones previously pushed
+func PushMetrics(ctx context.Context, fetcher gcs.Fetcher, gatewayUrl string, metrics []byte) error {
+	url := fmt.Sprintf("%s/metrics/job/metal-ipi-flakes", strings.TrimSuffix(gatewayUrl, "/"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(metrics))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := fetcher.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return &gcs.HttpStatusError{Url: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return nil
+}
@@ -0,0 +1,532 @@
+package flakes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	texttemplate "text/template"
+
+	"github.com/andfasano/metal-ipi-releases/internal/release"
+)
+
+// slackServer is a fake Slack accepting the messages posted to /ok,
+// and rejecting the ones posted elsewhere
+type slackServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	messages map[string][]string
+}
+
+func newSlackServer(t *testing.T) *slackServer {
+	s := &slackServer{messages: make(map[string][]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.messages[r.URL.Path] = append(s.messages[r.URL.Path], string(body))
+		s.mu.Unlock()
+		if r.URL.Path != "/ok" {
+			http.Error(w, "invalid_token", http.StatusForbidden)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestNotifySlack(t *testing.T) {
+	j := parseFixtureJob(t)
+	slack := newSlackServer(t)
+	key := j.notificationKey()
+	// Not matching the job name, so that no payload is looked up
+	rs := release.Stream{Prefix: "periodic-ci-openshift-release-master-ci-"}
+
+	webhook := func(pattern, path string) slackWebhook {
+		return slackWebhook{pattern: regexp.MustCompile(pattern), url: slack.URL + path}
+	}
+
+	tests := []struct {
+		name     string
+		webhooks []slackWebhook
+		notified map[string]string
+		posted   int
+		recorded bool
+	}{
+		{
+			name:     "no webhooks",
+			notified: map[string]string{},
+		},
+		{
+			name:     "accepted",
+			webhooks: []slackWebhook{webhook("metal-ipi", "/ok")},
+			notified: map[string]string{},
+			posted:   1,
+			recorded: true,
+		},
+		{
+			name:     "rejected",
+			webhooks: []slackWebhook{webhook("metal-ipi", "/fail")},
+			notified: map[string]string{},
+			posted:   1,
+		},
+		{
+			name:     "rejected by one of the webhooks",
+			webhooks: []slackWebhook{webhook("metal-ipi", "/ok"), webhook("4.10", "/fail")},
+			notified: map[string]string{},
+			posted:   2,
+		},
+		{
+			name:     "other jobs webhook",
+			webhooks: []slackWebhook{webhook("upgrade", "/fail")},
+			notified: map[string]string{},
+			recorded: true,
+		},
+		{
+			name:     "already notified",
+			webhooks: []slackWebhook{webhook("metal-ipi", "/fail")},
+			notified: map[string]string{j.Name: key},
+			recorded: true,
+		},
+		{
+			name:     "changed since notified",
+			webhooks: []slackWebhook{webhook("metal-ipi", "/ok")},
+			notified: map[string]string{j.Name: "true"},
+			posted:   1,
+			recorded: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slack.messages = make(map[string][]string)
+			s := &Slack{Webhooks: tt.webhooks, Top: 5, Fetcher: http.DefaultClient}
+			s.Notify(context.Background(), []*Job{j}, nil, rs, tt.notified)
+
+			posted := 0
+			for _, messages := range slack.messages {
+				for _, m := range messages {
+					if !strings.Contains(m, j.Name) {
+						t.Errorf("expected the job in the message, got %s", m)
+					}
+				}
+				posted += len(messages)
+			}
+			if posted != tt.posted {
+				t.Errorf("expected %d messages, got %d", tt.posted, posted)
+			}
+			if recorded := tt.notified[j.Name] == key; recorded != tt.recorded {
+				t.Errorf("expected notified %t, got %t", tt.recorded, recorded)
+			}
+		})
+	}
+}
+
+func TestParseSlackWebhooks(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []string
+		expected []string
+		wantErr  bool
+	}{
+		{
+			name:     "none",
+			expected: []string{},
+		},
+		{
+			name:     "valid",
+			values:   []string{"metal-ipi=https://hooks.slack.com/services/a", "upgrade=https://hooks.slack.com/services/b=c"},
+			expected: []string{"metal-ipi https://hooks.slack.com/services/a", "upgrade https://hooks.slack.com/services/b=c"},
+		},
+		{
+			name:    "missing url",
+			values:  []string{"metal-ipi"},
+			wantErr: true,
+		},
+		{
+			name:    "not an url",
+			values:  []string{"metal-ipi=hooks.slack.com"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid regex",
+			values:  []string{"metal-ipi(=https://hooks.slack.com/services/a"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webhooks, err := ParseSlackWebhooks(tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := []string{}
+			for _, w := range webhooks {
+				got = append(got, w.pattern.String()+" "+w.url)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestSlackSummary(t *testing.T) {
+	j := parseFixtureJob(t)
+	builds := j.builds
+	flaky := "`[sig-network] Services should serve endpoints`"
+
+	tests := []struct {
+		name        string
+		builds      int
+		top         int
+		payload     string
+		expected    []string
+		notExpected []string
+	}{
+		{
+			name:        "first run",
+			builds:      len(builds),
+			top:         5,
+			expected:    []string{"6 new builds, the newest one", "105> failed", "Top flaky tests:\n• 0.40 " + flaky + " (failed 2/5 runs)", "1 consistently failing tests"},
+			notExpected: []string{"New flaky tests"},
+		},
+		{
+			name:     "new flaky test",
+			builds:   5,
+			top:      5,
+			expected: []string{"5 new builds", "New flaky tests:\n• " + flaky},
+		},
+		{
+			name:        "flaky test seen before",
+			builds:      3,
+			top:         5,
+			expected:    []string{"3 new builds", "Top flaky tests"},
+			notExpected: []string{"New flaky tests"},
+		},
+		{
+			name:        "no top flaky tests",
+			builds:      len(builds),
+			top:         0,
+			payload:     "Newest 4.10 payload 4.10.0-0.nightly: Rejected\n",
+			expected:    []string{"consistently failing tests\nNewest 4.10 payload"},
+			notExpected: []string{"Top flaky tests"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j.builds = builds[:tt.builds]
+
+			summary := j.slackSummary(tt.payload, tt.top)
+			if !strings.HasPrefix(summary, fmt.Sprintf("*<%s|%s>*", j.HistoryUrl(), j.Name)) {
+				t.Errorf("expected the job link first, got %s", summary)
+			}
+			for _, e := range tt.expected {
+				if !strings.Contains(summary, e) {
+					t.Errorf("expected %q in %s", e, summary)
+				}
+			}
+			for _, e := range tt.notExpected {
+				if strings.Contains(summary, e) {
+					t.Errorf("expected no %q in %s", e, summary)
+				}
+			}
+		})
+	}
+}
+
+func TestIssueSearchText(t *testing.T) {
+	tests := []struct {
+		test     string
+		expected string
+	}{
+		{
+			test:     "[sig-network] Services should serve endpoints [Conformance] [Suite:openshift/conformance/parallel]",
+			expected: "Services should serve endpoints",
+		},
+		{
+			test:     `[sig-cli] oc  adm "must-gather" runs`,
+			expected: "oc adm must-gather runs",
+		},
+		{
+			test:     "[sig-storage] " + strings.Repeat("volume ", 20),
+			expected: strings.TrimSpace(strings.Repeat("volume ", 14)),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.test, func(t *testing.T) {
+			if got := issueSearchText(tt.test); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+// githubServer is a fake GitHub API, finding the open issues whose title
+// matches the searched text, and filing new ones
+type githubServer struct {
+	*httptest.Server
+	issues []GithubIssue
+	filed  []map[string]string
+}
+
+func newGithubServer(t *testing.T) *githubServer {
+	s := &githubServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/search/issues":
+			q := r.URL.Query().Get("q")
+			if !strings.HasPrefix(q, "repo:openshift/metal-ipi is:issue is:open in:title ") {
+				http.Error(w, "unexpected query "+q, http.StatusUnprocessableEntity)
+				return
+			}
+			result := struct {
+				Items []GithubIssue `json:"items"`
+			}{Items: []GithubIssue{}}
+			for _, i := range s.issues {
+				if strings.Contains(q, fmt.Sprintf("%q", i.Title)) {
+					result.Items = append(result.Items, i)
+				}
+			}
+			json.NewEncoder(w).Encode(result)
+		case r.Method == http.MethodPost && r.URL.Path == "/repos/openshift/metal-ipi/issues":
+			request := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&request)
+			s.filed = append(s.filed, request)
+			json.NewEncoder(w).Encode(GithubIssue{Number: 100 + len(s.filed), Title: request["title"]})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestCorrelateIssues(t *testing.T) {
+	j := parseFixtureJob(t)
+	github := newGithubServer(t)
+	tmpl := texttemplate.Must(texttemplate.New("issue").Parse(DefaultIssueTemplate))
+	test := "[sig-network] Services should serve endpoints"
+
+	tests := []struct {
+		name     string
+		apiUrl   string
+		issues   []GithubIssue
+		file     bool
+		expected *GithubIssue
+		filed    int
+		found    bool
+	}{
+		{
+			name:     "tracked",
+			issues:   []GithubIssue{{Number: 12, Title: "Services should serve endpoints"}},
+			file:     true,
+			expected: &GithubIssue{Number: 12, Title: "Services should serve endpoints"},
+			found:    true,
+		},
+		{
+			name:   "untracked",
+			issues: []GithubIssue{{Number: 13, Title: "Pods should be evicted"}},
+			found:  true,
+		},
+		{
+			name:     "filed",
+			file:     true,
+			expected: &GithubIssue{Number: 101, Title: "Flaky test: " + test},
+			filed:    1,
+			found:    true,
+		},
+		{
+			name:   "search failed",
+			apiUrl: "/unavailable",
+			file:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github.issues, github.filed = tt.issues, nil
+			gh := &Github{ApiUrl: github.URL + tt.apiUrl, Repo: "openshift/metal-ipi", FileIssues: tt.file, Fetcher: http.DefaultClient}
+
+			j.CorrelateIssues(context.Background(), gh, tmpl)
+			issue, found := j.issues[test]
+			if found != tt.found || !reflect.DeepEqual(issue, tt.expected) {
+				t.Errorf("expected %v (%t), got %v (%t)", tt.expected, tt.found, issue, found)
+			}
+			if len(github.filed) != tt.filed {
+				t.Fatalf("expected %d issues filed, got %d", tt.filed, len(github.filed))
+			}
+			for _, f := range github.filed {
+				if !strings.Contains(f["body"], "is flaky in ["+j.Name+"]") || !strings.Contains(f["body"], j.BuildUrl("103")) {
+					t.Errorf("expected the job and the failed builds in the issue, got %s", f["body"])
+				}
+			}
+		})
+	}
+}
+
+func TestJqlPhrase(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{
+			text:     "Services should serve endpoints",
+			expected: `"\"Services should serve endpoints\""`,
+		},
+		{
+			text:     `fail [k8s.io/e2e/network.go:42]: "timed out" (waiting+retrying)`,
+			expected: `"\"fail k8s.io e2e network.go 42 timed out waiting retrying\""`,
+		},
+		{
+			text:     strings.Repeat("timeout ", 20),
+			expected: `"\"` + strings.TrimSpace(strings.Repeat("timeout ", 10)) + `\""`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := jqlPhrase(tt.text); got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestSearchBugs(t *testing.T) {
+	var jql string
+	jira := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rest/api/2/search" {
+			http.NotFound(w, r)
+			return
+		}
+		jql = r.URL.Query().Get("jql")
+		w.Write([]byte(`{"issues": [{"key": "OCPBUGS-1", "fields": {"summary": "Services flaking", "status": {"name": "New"}}}]}`))
+	}))
+	defer jira.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		test     FlakyTest
+		jql      string
+		expected []JiraBug
+		wantErr  bool
+	}{
+		{
+			name: "by name",
+			test: FlakyTest{name: "[sig-network] Services should serve endpoints"},
+			jql:  `project = OCPBUGS AND (summary ~ "\"Services should serve endpoints\"") ORDER BY updated DESC`,
+			expected: []JiraBug{
+				{Key: "OCPBUGS-1", Summary: "Services flaking", Status: "New", Url: jira.URL + "/browse/OCPBUGS-1"},
+			},
+		},
+		{
+			name: "by failure message",
+			test: FlakyTest{
+				name:  "[sig-network] Services should serve endpoints",
+				modes: []FailureModeSummary{{Example: "timed out waiting\nfor the endpoints"}},
+			},
+			jql: `project = OCPBUGS AND (summary ~ "\"Services should serve endpoints\"" OR text ~ "\"timed out waiting\"") ORDER BY updated DESC`,
+			expected: []JiraBug{
+				{Key: "OCPBUGS-1", Summary: "Services flaking", Status: "New", Url: jira.URL + "/browse/OCPBUGS-1"},
+			},
+		},
+		{
+			name:    "unavailable",
+			path:    "/unavailable",
+			test:    FlakyTest{name: "[sig-network] Services should serve endpoints"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &Jira{Url: jira.URL + tt.path, Project: "OCPBUGS", Fetcher: http.DefaultClient}
+			jql = ""
+
+			bugs, err := client.searchBugs(context.Background(), tt.test)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if jql != tt.jql {
+				t.Errorf("expected query %s, got %s", tt.jql, jql)
+			}
+			if !reflect.DeepEqual(bugs, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, bugs)
+			}
+		})
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	j := parseFixtureJob(t)
+
+	var buf strings.Builder
+	if err := WriteMetrics(context.Background(), &buf, []*Job{j}, nil, release.Streams["nightly"], nil); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "metrics.prom", []byte(buf.String()))
+}
+
+func TestPushMetrics(t *testing.T) {
+	var pushed []string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/metrics/job/metal-ipi-flakes" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Content-Type") != "text/plain; version=0.0.4" {
+			http.Error(w, "unexpected content type", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		pushed = append(pushed, string(body))
+	}))
+	defer gateway.Close()
+
+	tests := []struct {
+		name    string
+		url     string
+		wantErr bool
+	}{
+		{
+			name: "pushed",
+			url:  gateway.URL,
+		},
+		{
+			name: "trailing slash",
+			url:  gateway.URL + "/",
+		},
+		{
+			name:    "wrong url",
+			url:     gateway.URL + "/prometheus",
+			wantErr: true,
+		},
+	}
+
+	metrics := "metal_ipi_job_flaky_tests{prow_job=\"job\"} 1\n"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pushed = nil
+			err := PushMetrics(context.Background(), http.DefaultClient, tt.url, []byte(metrics))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(pushed, []string{metrics}) {
+				t.Errorf("expected the metrics to be pushed, got %q", pushed)
+			}
+		})
+	}
+}
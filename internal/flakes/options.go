@@ -0,0 +1,149 @@
+// Package flakes analyzes the builds of the Prow jobs, to find the tests
+// failing intermittently, and reports them
+package flakes
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/andfasano/metal-ipi-releases/internal/gcs"
+	"github.com/andfasano/metal-ipi-releases/internal/prow"
+)
+
+// Options tells how the jobs builds are analyzed and reported
+type Options struct {
+	// Downloads the builds artifacts
+	Client *gcs.Client
+	// Where the analysis results are stored
+	CacheDir string
+
+	// Tests whose name matches any of these patterns are not analyzed
+	IgnoreTests Patterns
+	// If set, only the tests whose name matches any of these patterns
+	// are analyzed
+	IncludeTests Patterns
+
+	// How many builds are analyzed for every job
+	NumBuilds int
+	// How many of the newest analyzed builds are kept in the history of
+	// every job, the older ones being pruned. If not set, NumBuilds are kept
+	RetainBuilds int
+	// If set, all the builds finished within this time window are analyzed,
+	// instead of the last NumBuilds ones. The Until bound is excluded
+	Since time.Time
+	Until time.Time
+	// If set, only the builds of the pull requests within this range are
+	// analyzed for the pull requests jobs
+	PullsFrom int
+	PullsTo   int
+	// The steps layout overrides of the jobs not detected automatically
+	Layouts []prow.JobLayout
+
+	// Install steps lasting longer than this are considered timed out
+	InstallTimeout time.Duration
+	// Builds lasting longer than this were stopped by Prow
+	ProwTimeout time.Duration
+	// If set, the metal3 pods logs of the failed builds are scanned for
+	// provisioning errors
+	Metal3Logs bool
+	// The known failure signatures the failed builds are labelled with
+	FailureRules []prow.FailureRule
+
+	// If set, the saved analysis results are ignored and rebuilt from
+	// the downloaded files
+	RebuildCache bool
+	// If set, the tests history is kept on disk rather than in memory
+	LowMemory bool
+
+	// How a flaky test is detected: either "flips", for the tests changing
+	// their state, or "failure-rate", for the tests failing sometimes but
+	// less often than MaxFailureRate
+	FlakeDefinition string
+	MaxFailureRate  float64
+	// Tests failing at least that often are reported as consistently
+	// failing rather than flaky
+	PermafailRate float64
+	// Tests flaking less often than that are not reported
+	MinFlakiness float64
+	// If set, only the top flaky tests of every job are reported
+	Top int
+	// Tests whose median duration grew less than this are not reported as slower
+	MinSlowdown time.Duration
+	// How much the pass rate or the flakiness of a test must change
+	// between two time windows to be reported
+	MinChange float64
+	// If set, the reports include the builds where every test flaked
+	ShowDetails bool
+}
+
+// DefaultOptions returns the options used when not set otherwise, storing
+// all the cached data and the analysis results in the given folder
+func DefaultOptions(cacheDir string) *Options {
+	return &Options{
+		Client:   gcs.NewClient(filepath.Join(cacheDir, "http")),
+		CacheDir: cacheDir,
+		IgnoreTests: Patterns{
+			ExactMatch("[sig-arch] Monitor cluster while tests execute"),
+		},
+		IncludeTests:    Patterns{},
+		NumBuilds:       10,
+		InstallTimeout:  2 * time.Hour,
+		ProwTimeout:     4 * time.Hour,
+		FlakeDefinition: "flips",
+		MaxFailureRate:  0.5,
+		PermafailRate:   1.0,
+		MinSlowdown:     30 * time.Second,
+		MinChange:       0.1,
+	}
+}
+
+// ignoreTest tells if the given test is not analyzed
+func (o *Options) ignoreTest(name string) bool {
+	if o.IgnoreTests.MatchString(name) {
+		return true
+	}
+	return len(o.IncludeTests) > 0 && !o.IncludeTests.MatchString(name)
+}
+
+// windowed tells if the builds are selected by a time window, rather
+// than by their number
+func (o *Options) windowed() bool {
+	return !o.Since.IsZero() || !o.Until.IsZero()
+}
+
+// Patterns is a list of patterns, extended every time the flag is set
+type Patterns []*regexp.Regexp
+
+func (r *Patterns) String() string {
+	patterns := []string{}
+	for _, re := range *r {
+		patterns = append(patterns, re.String())
+	}
+	return strings.Join(patterns, " ")
+}
+
+func (r *Patterns) Set(value string) error {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, re)
+	return nil
+}
+
+// MatchString tells if any of the patterns matches the given string
+func (r Patterns) MatchString(s string) bool {
+	for _, re := range r {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExactMatch returns a pattern matching only the given string
+func ExactMatch(s string) *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(s) + "$")
+}
@@ -0,0 +1,1478 @@
+package flakes
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andfasano/metal-ipi-releases/internal/release"
+)
+
+// FlakyTest is a test considered flaky in the analyzed builds
+type FlakyTest struct {
+	name      string
+	flakiness float32
+	passRate  float32
+	runs      int
+	failures  int
+	streak    int
+	maxStreak int
+	firstSeen int64
+	lastSeen  int64
+	builds    []string
+	// The builds where the test failed, from the newest one
+	failedBuilds []string
+	modes        []FailureModeSummary
+	sippy        *release.SippySummary
+	issue        *GithubIssue
+	// Set when the test was looked up in the GitHub issues
+	issueChecked bool
+	bugs         []JiraBug
+}
+
+// BuildLink points to the Prow page and to the artifacts of a build
+type BuildLink struct {
+	Id           string `json:"id"`
+	Url          string `json:"url"`
+	ArtifactsUrl string `json:"artifactsUrl"`
+}
+
+// FailureModeSummary is a failure mode of a reported test
+type FailureModeSummary struct {
+	Signature string `json:"signature"`
+	Count     int    `json:"count"`
+	Example   string `json:"example"`
+	LastBuild string `json:"lastBuild"`
+}
+
+// failureModes returns the test failure modes, from the most frequent one
+func (th TestHistory) failureModes() []FailureModeSummary {
+	modes := []FailureModeSummary{}
+	for signature, fm := range th.FailureModes {
+		modes = append(modes, FailureModeSummary{
+			Signature: signature,
+			Count:     fm.Count,
+			Example:   fm.Example,
+			LastBuild: fm.LastBuild,
+		})
+	}
+	sort.Slice(modes, func(i, j int) bool {
+		if modes[i].Count != modes[j].Count {
+			return modes[i].Count > modes[j].Count
+		}
+		return modes[i].Signature < modes[j].Signature
+	})
+	return modes
+}
+
+// isFlaky tells if a test is flaky, according to the selected definition
+func (o *Options) isFlaky(th TestHistory) bool {
+	switch o.FlakeDefinition {
+	case "failure-rate":
+		return th.Failures > 0 && 1-th.PassRate() < float32(o.MaxFailureRate)
+	default:
+		return th.Flakes > 0
+	}
+}
+
+// isPermafailing tells if a test fails consistently, rather than flaking
+func (o *Options) isPermafailing(th TestHistory) bool {
+	return th.Runs > 0 && 1-th.PassRate() >= float32(o.PermafailRate)
+}
+
+func (j *Job) newFlakyTest(name string, th TestHistory) FlakyTest {
+	f := FlakyTest{
+		name:      name,
+		flakiness: th.Flakes / j.history.TotalBuilds,
+		passRate:  th.PassRate(),
+		runs:      th.Runs,
+		failures:  th.Failures,
+		streak:    th.Streak,
+		maxStreak: th.MaxStreak,
+		firstSeen: th.FirstSeen,
+		lastSeen:  th.LastSeen,
+		builds:    th.Builds,
+		modes:     th.failureModes(),
+		sippy:     j.sippy[name],
+	}
+	f.issue, f.issueChecked = j.issues[name]
+	f.bugs = j.bugs[name]
+
+	for i := len(th.FailedBuilds) - 1; i >= 0; i-- {
+		f.failedBuilds = append(f.failedBuilds, th.FailedBuilds[i])
+	}
+	return f
+}
+
+// flakyTests returns the reported flaky tests, from the most flaky one
+func (j *Job) flakyTests() []FlakyTest {
+	flakes := []FlakyTest{}
+	j.reportTests().ForEach(func(k string, v TestHistory) {
+		// Consistently failing tests are reported apart
+		if !j.opts.isFlaky(v) || j.opts.isPermafailing(v) {
+			return
+		}
+
+		f := j.newFlakyTest(k, v)
+		if float64(f.flakiness) < j.opts.MinFlakiness {
+			return
+		}
+		flakes = append(flakes, f)
+	})
+
+	byPassRate := j.opts.FlakeDefinition == "failure-rate"
+	sort.Slice(flakes, func(i, j int) bool {
+		if byPassRate && flakes[i].passRate != flakes[j].passRate {
+			return flakes[i].passRate < flakes[j].passRate
+		}
+		return flakes[i].flakiness > flakes[j].flakiness
+	})
+
+	return flakes
+}
+
+// topFlakyTests returns the flaky tests to report, honoring the -top option
+func (j *Job) topFlakyTests() []FlakyTest {
+	flakes := j.flakyTests()
+	if top := j.opts.Top; top > 0 && len(flakes) > top {
+		flakes = flakes[:top]
+	}
+	return flakes
+}
+
+// permafailingTests returns the consistently failing tests, from
+// the one failing most often
+func (j *Job) permafailingTests() []FlakyTest {
+	failing := []FlakyTest{}
+	j.reportTests().ForEach(func(k string, v TestHistory) {
+		if j.opts.isPermafailing(v) {
+			failing = append(failing, j.newFlakyTest(k, v))
+		}
+	})
+
+	sort.Slice(failing, func(i, j int) bool {
+		if failing[i].failures != failing[j].failures {
+			return failing[i].failures > failing[j].failures
+		}
+		return failing[i].name < failing[j].name
+	})
+
+	return failing
+}
+
+var testSigRe = regexp.MustCompile(`\[(sig-[\w-]+)\]`)
+
+// testSig returns the special interest group owning a test, as tagged in
+// its name, e.g. sig-network. Untagged tests have no sig
+func testSig(name string) string {
+	if m := testSigRe.FindStringSubmatch(name); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// SigSummary aggregates the flaky and the consistently failing tests
+// owned by the same sig
+type SigSummary struct {
+	Sig          string
+	Flaky        int
+	Permafailing int
+	// The failures of all the flaky and consistently failing tests
+	Failures int
+}
+
+// sigSummaries groups the flaky and the consistently failing tests by
+// sig, starting from the sigs with the most of them
+func (j *Job) sigSummaries() []SigSummary {
+	sigs := make(map[string]*SigSummary)
+	get := func(name string) *SigSummary {
+		sig := testSig(name)
+		if _, ok := sigs[sig]; !ok {
+			sigs[sig] = &SigSummary{Sig: sig}
+		}
+		return sigs[sig]
+	}
+	for _, f := range j.flakyTests() {
+		s := get(f.name)
+		s.Flaky++
+		s.Failures += f.failures
+	}
+	for _, f := range j.permafailingTests() {
+		s := get(f.name)
+		s.Permafailing++
+		s.Failures += f.failures
+	}
+
+	summaries := []SigSummary{}
+	for _, s := range sigs {
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(a, b int) bool {
+		x, y := summaries[a], summaries[b]
+		if x.Flaky+x.Permafailing != y.Flaky+y.Permafailing {
+			return x.Flaky+x.Permafailing > y.Flaky+y.Permafailing
+		}
+		if x.Failures != y.Failures {
+			return x.Failures > y.Failures
+		}
+		return x.Sig < y.Sig
+	})
+	return summaries
+}
+
+// sigName returns how a sig is shown in the reports
+func sigName(sig string) string {
+	if sig == "" {
+		return "(no sig)"
+	}
+	return sig
+}
+
+// ShowSigSummaries reports the flaky and the consistently failing tests by
+// sig, to route them to the owning teams
+func (j *Job) ShowSigSummaries() {
+	summaries := j.sigSummaries()
+	if len(summaries) == 0 {
+		return
+	}
+
+	fmt.Printf("\n[%s] Flaky tests by sig\n", j.Name)
+	fmt.Printf("%-35s%-8s%-14s%s\n", "SIG", "FLAKY", "PERMAFAILING", "FAILURES")
+	for _, s := range summaries {
+		fmt.Printf("%-35s%-8d%-14d%d\n", sigName(s.Sig), s.Flaky, s.Permafailing, s.Failures)
+	}
+}
+
+// ShowInRunFlakes reports the tests that failed but passed when retried
+// within the same run, that are not counted as flakes across the builds
+func (j *Job) ShowInRunFlakes() {
+	type inRunFlake struct {
+		name   string
+		builds []string
+		runs   int
+	}
+
+	flakes := []inRunFlake{}
+	j.reportTests().ForEach(func(name string, th TestHistory) {
+		if len(th.InRunFlakeBuilds) > 0 {
+			flakes = append(flakes, inRunFlake{name: name, builds: th.InRunFlakeBuilds, runs: th.Runs})
+		}
+	})
+	if len(flakes) == 0 {
+		return
+	}
+	sort.Slice(flakes, func(a, b int) bool {
+		if len(flakes[a].builds) != len(flakes[b].builds) {
+			return len(flakes[a].builds) > len(flakes[b].builds)
+		}
+		return flakes[a].name < flakes[b].name
+	})
+
+	fmt.Printf("\n[%s] Tests passing when retried within the same run (%d)\n", j.Name, len(flakes))
+	fmt.Printf("%-9s%s\n", "RETRIED", "TEST")
+	for _, f := range flakes {
+		fmt.Printf("%-9s%s\n", fmt.Sprintf("%d/%d", len(f.builds), f.runs), f.name)
+		if j.opts.ShowDetails {
+			for i := len(f.builds) - 1; i >= 0; i-- {
+				fmt.Printf("%9s%s\n", "", j.BuildUrl(f.builds[i]))
+			}
+		}
+	}
+}
+
+func (j *Job) ShowPermafailingTests() {
+	failing := j.permafailingTests()
+	if len(failing) == 0 {
+		return
+	}
+
+	fmt.Printf("\n[%s] Consistently failing tests (failing in at least %.0f%% of the runs)\n", j.Name, j.opts.PermafailRate*100)
+	fmt.Printf("%-9s%-16s%-12s%s\n", "FAILS", "CURRENT STREAK", "MAX STREAK", "TEST")
+	for _, f := range failing {
+		fmt.Printf("%-9s%-16d%-12d%s\n", fmt.Sprintf("%d/%d", f.failures, f.runs), f.streak, f.maxStreak, f.name)
+	}
+}
+
+// showFailureModes lists the most frequent ways a test failed
+func (f FlakyTest) showFailureModes() {
+	const maxModes = 3
+	for i, m := range f.modes {
+		if i == maxModes {
+			fmt.Printf("%64s... and %d more failure modes\n", "", len(f.modes)-maxModes)
+			break
+		}
+		example := strings.SplitN(m.Example, "\n", 2)[0]
+		if len(example) > 120 {
+			example = example[:120] + "..."
+		}
+		fmt.Printf("%64s%dx %s\n", "", m.Count, example)
+	}
+}
+
+func (j *Job) ShowIntermittentFailures() {
+	flakes := j.topFlakyTests()
+
+	to := time.Unix(j.history.To, 0).UTC()
+	from := time.Unix(j.history.From, 0).UTC()
+	fmt.Println("-----------------------------------------")
+	fmt.Printf("\n[%s] Top flaky tests (last %0.f days, %0.f builds)\n", j.Name, to.Sub(from).Hours()/24, j.history.TotalBuilds)
+	fmt.Printf("%-8s%-11s%-9s%-12s%-12s%-12s%s\n", "FLAKES", "PASS RATE", "FAILS", "MAX STREAK", "FIRST SEEN", "LAST SEEN", "TEST")
+	for _, f := range flakes {
+		fails := fmt.Sprintf("%d/%d", f.failures, f.runs)
+		fmt.Printf("%-8.2f%-11s%-9s%-12d%-12s%-12s%s\n", f.flakiness, fmt.Sprintf("%.0f%%", f.passRate*100), fails, f.maxStreak, formatDate(f.firstSeen), formatDate(f.lastSeen), f.name)
+		f.showFailureModes()
+		if f.sippy != nil {
+			f.sippy.Show()
+		}
+		if f.issueChecked {
+			fmt.Printf("%64s%s\n", "", j.issueStatus(f))
+		}
+		if len(f.bugs) > 0 {
+			bugs := []string{}
+			for _, b := range f.bugs {
+				bugs = append(bugs, fmt.Sprintf("%s (%s)", b.Key, b.Status))
+			}
+			fmt.Printf("%64sbugs: %s\n", "", strings.Join(bugs, ", "))
+		}
+		if j.opts.ShowDetails {
+			for _, l := range j.buildLinks(f.failedBuilds) {
+				fmt.Printf("%64s%s\n", "", l.Url)
+				fmt.Printf("%64s%s\n", "", l.ArtifactsUrl)
+			}
+		} else if len(f.failedBuilds) > 0 {
+			fmt.Printf("%64sfailed in %s\n", "", strings.Join(f.failedBuilds, " "))
+		}
+	}
+	if hidden := len(j.flakyTests()) - len(flakes); hidden > 0 {
+		fmt.Printf("... and %d more flaky tests, not shown because of -top\n", hidden)
+	}
+}
+
+// buildLinks returns the links to the given builds
+func (j *Job) buildLinks(ids []string) []BuildLink {
+	links := []BuildLink{}
+	for _, id := range ids {
+		links = append(links, BuildLink{
+			Id:           id,
+			Url:          j.BuildUrl(id),
+			ArtifactsUrl: j.ArtifactsUrl(id),
+		})
+	}
+	return links
+}
+
+// formatDate shows a timestamp as a date, or a placeholder when not known
+func formatDate(ts int64) string {
+	if ts == 0 {
+		return "-"
+	}
+	return time.Unix(ts, 0).UTC().Format("2006-01-02")
+}
+
+// FlakeRecord is a flaky test in the machine readable reports
+type FlakeRecord struct {
+	Job  string `json:"job"`
+	Test string `json:"test"`
+	Sig  string `json:"sig,omitempty"`
+	// Either flaky or permafailing
+	Kind           string    `json:"kind"`
+	Flakiness      float32   `json:"flakiness"`
+	PassRate       float32   `json:"passRate"`
+	Runs           int       `json:"runs"`
+	Failures       int       `json:"failures"`
+	MaxStreak      int       `json:"maxStreak"`
+	BuildsAnalyzed int       `json:"buildsAnalyzed"`
+	From           time.Time `json:"from"`
+	To             time.Time `json:"to"`
+	// When the test flaked for the first and the last time, unset for
+	// the tests that never changed their state
+	FirstSeen *time.Time `json:"firstSeen,omitempty"`
+	LastSeen  *time.Time `json:"lastSeen,omitempty"`
+	Builds    []string   `json:"builds"`
+	// The builds where the test failed, from the newest one
+	FailedBuilds []BuildLink `json:"failedBuilds"`
+	// Only reported in json
+	FailureModes []FailureModeSummary  `json:"failureModes"`
+	Sippy        *release.SippySummary `json:"sippy,omitempty"`
+	Issue        *GithubIssue          `json:"issue,omitempty"`
+	Bugs         []JiraBug             `json:"bugs,omitempty"`
+}
+
+// FlakeRecords returns the job flaky and consistently failing tests
+// for the machine readable reports
+func (j *Job) FlakeRecords() []FlakeRecord {
+	records := []FlakeRecord{}
+	add := func(kind string, f FlakyTest) {
+		records = append(records, FlakeRecord{
+			Job:            j.Name,
+			Test:           f.name,
+			Sig:            testSig(f.name),
+			Kind:           kind,
+			Flakiness:      f.flakiness,
+			PassRate:       f.passRate,
+			Runs:           f.runs,
+			Failures:       f.failures,
+			MaxStreak:      f.maxStreak,
+			BuildsAnalyzed: int(j.history.TotalBuilds),
+			From:           time.Unix(j.history.From, 0).UTC(),
+			To:             time.Unix(j.history.To, 0).UTC(),
+			FirstSeen:      optionalTime(f.firstSeen),
+			LastSeen:       optionalTime(f.lastSeen),
+			Builds:         f.builds,
+			FailedBuilds:   j.buildLinks(f.failedBuilds),
+			FailureModes:   f.modes,
+			Sippy:          f.sippy,
+			Issue:          f.issue,
+			Bugs:           f.bugs,
+		})
+	}
+
+	for _, f := range j.topFlakyTests() {
+		add("flaky", f)
+	}
+	for _, f := range j.permafailingTests() {
+		add("permafailing", f)
+	}
+	return records
+}
+
+// optionalTime converts the unix timestamp, unset when zero
+func optionalTime(ts int64) *time.Time {
+	if ts == 0 {
+		return nil
+	}
+	t := time.Unix(ts, 0).UTC()
+	return &t
+}
+
+// formatOptionalTime formats the time as RFC3339, empty when unset
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// WriteFlakeRecords prints the flaky tests of all the jobs in the given format
+func WriteFlakeRecords(w io.Writer, format string, records []FlakeRecord) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"job", "test", "kind", "flakiness", "pass_rate", "runs", "failures", "max_streak", "builds_analyzed", "from", "to", "first_seen", "last_seen", "builds", "failed_builds", "sig"})
+		for _, r := range records {
+			failedIds := []string{}
+			for _, l := range r.FailedBuilds {
+				failedIds = append(failedIds, l.Id)
+			}
+			cw.Write([]string{
+				r.Job,
+				r.Test,
+				r.Kind,
+				strconv.FormatFloat(float64(r.Flakiness), 'f', 4, 32),
+				strconv.FormatFloat(float64(r.PassRate), 'f', 4, 32),
+				strconv.Itoa(r.Runs),
+				strconv.Itoa(r.Failures),
+				strconv.Itoa(r.MaxStreak),
+				strconv.Itoa(r.BuildsAnalyzed),
+				r.From.Format(time.RFC3339),
+				r.To.Format(time.RFC3339),
+				formatOptionalTime(r.FirstSeen),
+				formatOptionalTime(r.LastSeen),
+				strings.Join(r.Builds, " "),
+				strings.Join(failedIds, " "),
+				r.Sig,
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("Unsupported output format %s", format)
+}
+
+// htmlReportTemplate renders a self-contained report, with every table
+// sortable by clicking on its headers
+const htmlReportTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>metal-ipi flaky tests</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #eee; cursor: pointer; }
+td.num { text-align: right; }
+</style>
+</head>
+<body>
+<h1>metal-ipi flaky tests</h1>
+<p>Generated on {{.Generated}}</p>
+{{- if .Payloads}}
+
+<h2>Payloads</h2>
+<table>
+<tr><th>Version</th><th>Last accepted</th><th>Age</th></tr>
+{{- range .Payloads}}
+<tr><td>{{.Version}}</td><td>{{if .Error}}{{.Error}}{{else}}{{.Payload}}{{end}}</td><td>{{.Age}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+
+<h2>Summary</h2>
+<table class="sortable">
+<tr><th>Job</th><th>Builds</th><th>From</th><th>To</th><th>Flaky tests</th></tr>
+{{- range .Jobs}}
+<tr><td><a href="#{{.Name}}">{{.Name}}</a></td><td class="num">{{.Builds}}</td><td>{{.From}}</td><td>{{.To}}</td><td class="num">{{.FlakyTests}}</td></tr>
+{{- end}}
+</table>
+{{range .Jobs}}
+<h2 id="{{.Name}}"><a href="{{.HistoryUrl}}">{{.Name}}</a></h2>
+{{- if .Flakes}}
+<table class="sortable">
+<tr><th>Flakes</th><th>Pass rate</th><th>Failures</th><th>Runs</th><th>Max streak</th><th>First seen</th><th>Last seen</th><th>Test</th><th>Failed in</th></tr>
+{{- range .Flakes}}
+<tr><td class="num">{{printf "%.2f" .Flakiness}}</td><td class="num">{{printf "%.0f" .PassRate}}</td><td class="num">{{.Failures}}</td><td class="num">{{.Runs}}</td><td class="num">{{.MaxStreak}}</td><td>{{.FirstSeen}}</td><td>{{.LastSeen}}</td><td>{{.Test}}</td><td>{{range .Builds}}<a href="{{.Url}}">{{.Id}}</a> (<a href="{{.ArtifactsUrl}}">artifacts</a>) {{end}}</td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p>No flaky tests found</p>
+{{- end}}
+{{- if .Permafailing}}
+<h3>Consistently failing tests</h3>
+<table class="sortable">
+<tr><th>Failures</th><th>Runs</th><th>Max streak</th><th>Test</th></tr>
+{{- range .Permafailing}}
+<tr><td class="num">{{.Failures}}</td><td class="num">{{.Runs}}</td><td class="num">{{.MaxStreak}}</td><td>{{.Test}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{end}}
+<script>
+document.querySelectorAll("table.sortable th").forEach(function(th) {
+  th.addEventListener("click", function() {
+    var table = th.closest("table");
+    var rows = Array.from(table.rows).slice(1);
+    var col = th.cellIndex;
+    var asc = th.dataset.order !== "asc";
+    th.dataset.order = asc ? "asc" : "desc";
+    rows.sort(function(a, b) {
+      var x = a.cells[col].textContent, y = b.cells[col].textContent;
+      var cmp = (isNaN(x) || isNaN(y)) ? x.localeCompare(y) : x - y;
+      return asc ? cmp : -cmp;
+    });
+    rows.forEach(function(r) { table.tBodies[0].appendChild(r); });
+  });
+});
+</script>
+</body>
+</html>
+`
+
+// WriteHtmlReport prints a single page report with the flaky tests of all
+// the jobs, and the status of the given payloads if any
+func WriteHtmlReport(w io.Writer, jobs []*Job, payloads []release.PayloadStatus) error {
+	type flake struct {
+		Test      string
+		Flakiness float32
+		PassRate  float32
+		Failures  int
+		Runs      int
+		MaxStreak int
+		FirstSeen string
+		LastSeen  string
+		Builds    []BuildLink
+	}
+	type job struct {
+		Name         string
+		HistoryUrl   string
+		Builds       int
+		From         string
+		To           string
+		FlakyTests   int
+		Flakes       []flake
+		Permafailing []flake
+	}
+
+	data := struct {
+		Generated string
+		Payloads  []release.PayloadStatus
+		Jobs      []job
+	}{
+		Generated: time.Now().UTC().Format(time.RFC1123),
+		Payloads:  payloads,
+	}
+	for _, j := range jobs {
+		hj := job{
+			Name:       j.Name,
+			HistoryUrl: j.HistoryUrl(),
+			Builds:     int(j.history.TotalBuilds),
+			From:       formatDate(j.history.From),
+			To:         formatDate(j.history.To),
+		}
+		hj.FlakyTests = len(j.flakyTests())
+		for _, f := range j.topFlakyTests() {
+			hf := flake{
+				Test:      f.name,
+				Flakiness: f.flakiness,
+				PassRate:  f.passRate * 100,
+				Failures:  f.failures,
+				Runs:      f.runs,
+				MaxStreak: f.maxStreak,
+				FirstSeen: formatDate(f.firstSeen),
+				LastSeen:  formatDate(f.lastSeen),
+				Builds:    j.buildLinks(f.failedBuilds),
+			}
+			hj.Flakes = append(hj.Flakes, hf)
+		}
+		for _, f := range j.permafailingTests() {
+			hj.Permafailing = append(hj.Permafailing, flake{
+				Test:      f.name,
+				Failures:  f.failures,
+				Runs:      f.runs,
+				MaxStreak: f.maxStreak,
+			})
+		}
+		data.Jobs = append(data.Jobs, hj)
+	}
+
+	t, err := template.New("report").Parse(htmlReportTemplate)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, data)
+}
+
+// WriteMarkdownReport prints the flaky tests of all the jobs, ready to be
+// pasted in a GitHub issue, with a checklist to track their triage
+func WriteMarkdownReport(w io.Writer, jobs []*Job) error {
+	// Tests names are shown as code, so within the tables only the
+	// columns separator needs escaping
+	code := func(s string) string {
+		return "`" + s + "`"
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# metal-ipi flaky tests\n\n")
+	for _, j := range jobs {
+		flakes := j.topFlakyTests()
+
+		fmt.Fprintf(bw, "## [%s](%s)\n\n", j.Name, j.HistoryUrl())
+		fmt.Fprintf(bw, "%0.f builds analyzed, from %s to %s\n\n", j.history.TotalBuilds, formatDate(j.history.From), formatDate(j.history.To))
+		if len(flakes) == 0 {
+			fmt.Fprintf(bw, "No flaky tests found\n\n")
+		} else {
+			fmt.Fprintf(bw, "| Flakes | Pass rate | Failures | Max streak | First seen | Last seen | Test |\n")
+			fmt.Fprintf(bw, "|-------:|----------:|---------:|-----------:|------------|-----------|------|\n")
+			for _, f := range flakes {
+				fmt.Fprintf(bw, "| %.2f | %.0f%% | %d/%d | %d | %s | %s | %s |\n", f.flakiness, f.passRate*100, f.failures, f.runs, f.maxStreak, formatDate(f.firstSeen), formatDate(f.lastSeen), code(strings.ReplaceAll(f.name, "|", "\\|")))
+			}
+
+			fmt.Fprintf(bw, "\n### Triage\n\n")
+			for _, f := range flakes {
+				links := []string{}
+				for _, l := range j.buildLinks(f.failedBuilds) {
+					links = append(links, fmt.Sprintf("[%s](%s) ([artifacts](%s))", l.Id, l.Url, l.ArtifactsUrl))
+				}
+				tracking := ""
+				if f.issueChecked {
+					tracking = ", " + j.issueStatus(f)
+				}
+				for i, b := range f.bugs {
+					if i == 0 {
+						tracking += ", bugs:"
+					}
+					tracking += fmt.Sprintf(" [%s](%s) (%s)", b.Key, b.Url, b.Status)
+				}
+				fmt.Fprintf(bw, "- [ ] %s, failed in %s%s\n", code(f.name), strings.Join(links, ", "), tracking)
+			}
+			fmt.Fprintln(bw)
+		}
+
+		if failing := j.permafailingTests(); len(failing) > 0 {
+			fmt.Fprintf(bw, "### Consistently failing\n\n")
+			for _, f := range failing {
+				fmt.Fprintf(bw, "- [ ] %s (failed %d/%d runs)\n", code(f.name), f.failures, f.runs)
+			}
+			fmt.Fprintln(bw)
+		}
+
+		if summaries := j.sigSummaries(); len(summaries) > 0 {
+			fmt.Fprintf(bw, "### By sig\n\n")
+			fmt.Fprintf(bw, "| Sig | Flaky | Consistently failing | Failures |\n")
+			fmt.Fprintf(bw, "|-----|------:|---------------------:|---------:|\n")
+			for _, s := range summaries {
+				fmt.Fprintf(bw, "| %s | %d | %d | %d |\n", sigName(s.Sig), s.Flaky, s.Permafailing, s.Failures)
+			}
+			fmt.Fprintln(bw)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// percentile returns the p-th percentile of the given durations,
+// using the nearest-rank method
+func percentile(durations []time.Duration, p float64) time.Duration {
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// ShowStepDurations reports the p50/p90/p99 durations of every workflow step,
+// highlighting the ones whose recent builds are getting slower
+func (j *Job) ShowStepDurations() {
+	if len(j.history.StepDurations) == 0 {
+		return
+	}
+
+	steps := []string{}
+	for step := range j.history.StepDurations {
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+
+	fmt.Printf("\n[%s] Step durations\n", j.Name)
+	fmt.Printf("%-45s%-10s%-10s%-10s%s\n", "STEP", "P50", "P90", "P99", "TREND")
+	for _, step := range steps {
+		durations := j.history.StepDurations[step]
+
+		// Compare the median of the newest half of the builds with the oldest one
+		trend := ""
+		if half := len(durations) / 2; half > 0 {
+			recent := percentile(durations[:half], 50)
+			previous := percentile(durations[len(durations)-half:], 50)
+			if float64(recent) > float64(previous)*1.2 {
+				trend = fmt.Sprintf("creeping up (%s -> %s)", previous.Round(time.Minute), recent.Round(time.Minute))
+			}
+		}
+
+		fmt.Printf("%-45s%-10s%-10s%-10s%s\n", step,
+			percentile(durations, 50).Round(time.Second),
+			percentile(durations, 90).Round(time.Second),
+			percentile(durations, 99).Round(time.Second),
+			trend)
+	}
+}
+
+// ShowBuilds lists the analyzed builds, from the newest one, so that the
+// aggregated numbers can be checked against the single builds
+func (j *Job) ShowBuilds() {
+	if len(j.history.Builds) == 0 {
+		return
+	}
+
+	fmt.Printf("\n[%s] Analyzed builds (%d)\n", j.Name, len(j.history.Builds))
+	fmt.Printf("%-22s%-18s%-8s%-14s%s\n", "BUILD", "FINISHED", "RESULT", "FAILED TESTS", "URL")
+	for _, b := range j.history.Builds {
+		result := "passed"
+		if !b.Passed {
+			result = "failed"
+		}
+		finished := time.Unix(b.Timestamp, 0).UTC().Format("2006-01-02 15:04")
+		fmt.Printf("%-22s%-18s%-8s%-14d%s\n", b.Id, finished, result, b.FailedTests, j.BuildUrl(b.Id))
+	}
+}
+
+// ShowBuildDurations reports the average and p90 durations of the builds,
+// together with the ones lasting much longer than usual or stopped by
+// the Prow timeout
+func (j *Job) ShowBuildDurations() {
+	if len(j.history.BuildDurations) == 0 {
+		return
+	}
+
+	durations := []time.Duration{}
+	total := time.Duration(0)
+	for _, d := range j.history.BuildDurations {
+		durations = append(durations, d.Duration)
+		total += d.Duration
+	}
+	average := total / time.Duration(len(durations))
+	median := percentile(durations, 50)
+
+	fmt.Printf("\n[%s] Build durations: average %s, p90 %s\n", j.Name, average.Round(time.Minute), percentile(durations, 90).Round(time.Minute))
+	for _, d := range j.history.BuildDurations {
+		switch {
+		case d.Duration >= j.opts.ProwTimeout:
+			fmt.Printf("%s\t%s\ttimed out\n", d.Build, d.Duration.Round(time.Minute))
+		case float64(d.Duration) > float64(median)*1.5:
+			fmt.Printf("%s\t%s\tslower than usual\n", d.Build, d.Duration.Round(time.Minute))
+		}
+	}
+}
+
+// ShowSlowerTests reports the tests whose median duration grew by at least
+// half, comparing the newest half of their passing runs with the oldest one
+func (j *Job) ShowSlowerTests() {
+	type slower struct {
+		name     string
+		previous time.Duration
+		recent   time.Duration
+	}
+
+	tests := []slower{}
+	j.reportTests().ForEach(func(name string, th TestHistory) {
+		half := len(th.Durations) / 2
+		if half == 0 {
+			return
+		}
+		previous := percentile(th.Durations[:half], 50)
+		recent := percentile(th.Durations[len(th.Durations)-half:], 50)
+		if previous > 0 && float64(recent) >= float64(previous)*1.5 && recent-previous >= j.opts.MinSlowdown {
+			tests = append(tests, slower{name: name, previous: previous, recent: recent})
+		}
+	})
+	if len(tests) == 0 {
+		return
+	}
+	sort.Slice(tests, func(a, b int) bool {
+		return tests[a].recent-tests[a].previous > tests[b].recent-tests[b].previous
+	})
+
+	fmt.Printf("\n[%s] Slower tests (%d)\n", j.Name, len(tests))
+	fmt.Printf("%-12s%-12s%-10s%s\n", "PREVIOUS", "RECENT", "CHANGE", "TEST")
+	for _, t := range tests {
+		fmt.Printf("%-12s%-12s%-10s%s\n", t.previous.Round(time.Second), t.recent.Round(time.Second),
+			fmt.Sprintf("+%.0f%%", (float64(t.recent)/float64(t.previous)-1)*100), t.name)
+	}
+}
+
+// ShowFailureLabels reports how many failed builds matched every known
+// failure signature
+func (j *Job) ShowFailureLabels() {
+	if len(j.history.FailureLabels) == 0 && len(j.history.UnclassifiedFailures) == 0 {
+		return
+	}
+
+	labels := []string{}
+	for label := range j.history.FailureLabels {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(a, b int) bool {
+		x, y := j.history.FailureLabels[labels[a]], j.history.FailureLabels[labels[b]]
+		if len(x) != len(y) {
+			return len(x) > len(y)
+		}
+		return labels[a] < labels[b]
+	})
+
+	fmt.Printf("\n[%s] Failed builds by signature\n", j.Name)
+	fmt.Printf("%-25s%-8s%s\n", "LABEL", "BUILDS", "IDS")
+	for _, label := range labels {
+		ids := j.history.FailureLabels[label]
+		fmt.Printf("%-25s%-8d%s\n", label, len(ids), strings.Join(ids, " "))
+	}
+	if ids := j.history.UnclassifiedFailures; len(ids) > 0 {
+		fmt.Printf("%-25s%-8d%s\n", "(unclassified)", len(ids), strings.Join(ids, " "))
+	}
+}
+
+// ShowProvisioningErrors reports the most common categories of errors
+// logged by the metal3 pods of the failed builds
+func (j *Job) ShowProvisioningErrors() {
+	if len(j.history.ProvisioningErrors) == 0 {
+		return
+	}
+
+	categories := []string{}
+	for category := range j.history.ProvisioningErrors {
+		categories = append(categories, category)
+	}
+	sort.Slice(categories, func(a, b int) bool {
+		x, y := j.history.ProvisioningErrors[categories[a]], j.history.ProvisioningErrors[categories[b]]
+		if len(x.Builds) != len(y.Builds) {
+			return len(x.Builds) > len(y.Builds)
+		}
+		return categories[a] < categories[b]
+	})
+
+	fmt.Printf("\n[%s] Provisioning errors in the metal3 logs of the failed builds\n", j.Name)
+	fmt.Printf("%-20s%-8s%s\n", "CATEGORY", "BUILDS", "NEWEST ERROR")
+	for _, category := range categories {
+		pe := j.history.ProvisioningErrors[category]
+		example := pe.Example
+		if len(example) > 150 {
+			example = example[:150] + "..."
+		}
+		fmt.Printf("%-20s%-8d%s\n", category, len(pe.Builds), example)
+	}
+}
+
+// ShowStepFailures reports the workflow steps that failed, so that the
+// builds without tests could be attributed to the step that broke them
+func (j *Job) ShowStepFailures() {
+	if len(j.history.StepFailures) == 0 {
+		return
+	}
+
+	steps := []string{}
+	for step := range j.history.StepFailures {
+		steps = append(steps, step)
+	}
+	sort.Slice(steps, func(a, b int) bool {
+		na, nb := len(j.history.StepFailures[steps[a]]), len(j.history.StepFailures[steps[b]])
+		if na != nb {
+			return na > nb
+		}
+		return steps[a] < steps[b]
+	})
+
+	fmt.Printf("\n[%s] Failed workflow steps\n", j.Name)
+	fmt.Printf("%-45s%-8s%s\n", "STEP", "FAILS", "BUILDS")
+	for _, step := range steps {
+		builds := j.history.StepFailures[step]
+		fmt.Printf("%-45s%-8d%s\n", step, len(builds), strings.Join(builds, " "))
+	}
+}
+
+// ShowUpgradeEdges reports, for the upgrade jobs, how the builds of every
+// upgrade edge went, together with the tests failing most often on it
+func (j *Job) ShowUpgradeEdges() {
+	if len(j.history.UpgradeEdges) == 0 {
+		return
+	}
+
+	edges := []string{}
+	for edge := range j.history.UpgradeEdges {
+		edges = append(edges, edge)
+	}
+	sort.Strings(edges)
+
+	const maxTests = 5
+	fmt.Printf("\n[%s] Upgrade edges\n", j.Name)
+	fmt.Printf("%-40s%-8s%s\n", "EDGE", "BUILDS", "FAILED")
+	for _, edge := range edges {
+		e := j.history.UpgradeEdges[edge]
+		fmt.Printf("%-40s%-8d%d\n", edge, e.Builds, e.FailedBuilds)
+
+		tests := []string{}
+		for name := range e.TestFailures {
+			tests = append(tests, name)
+		}
+		sort.Slice(tests, func(a, b int) bool {
+			if e.TestFailures[tests[a]] != e.TestFailures[tests[b]] {
+				return e.TestFailures[tests[a]] > e.TestFailures[tests[b]]
+			}
+			return tests[a] < tests[b]
+		})
+		for i, name := range tests {
+			if i == maxTests {
+				fmt.Printf("%48s... and %d more failing tests\n", "", len(tests)-maxTests)
+				break
+			}
+			fmt.Printf("%48s%d/%d %s\n", "", e.TestFailures[name], e.Builds, name)
+		}
+	}
+}
+
+// ShowTeardownFailures reports the builds that did not release
+// their baremetal hosts
+func (j *Job) ShowTeardownFailures() {
+	if len(j.history.TeardownFailures) == 0 {
+		return
+	}
+
+	fmt.Printf("\n[%s] Builds with failed deprovisioning (%d)\n", j.Name, len(j.history.TeardownFailures))
+	for _, id := range j.history.TeardownFailures {
+		fmt.Printf("%s\t%s/artifacts/%s/%s/\n", id, j.ArtifactsUrl(id), j.SafeName, j.Layout.TeardownStep)
+	}
+}
+
+// ShowInstallFailures reports the builds where the cluster installation
+// failed, separating timeouts from fast failures, and how many failed
+// builds broke during the bootstrap, the install or the e2e tests
+func (j *Job) ShowInstallFailures() {
+	if len(j.history.InstallFailures) == 0 && len(j.history.E2eFailures) == 0 {
+		return
+	}
+
+	phases := make(map[string]int)
+	for _, f := range j.history.InstallFailures {
+		phases[f.Phase]++
+	}
+	fmt.Printf("\n[%s] Failed builds by phase: %d bootstrap, %d install, %d e2e", j.Name, phases["bootstrap"], phases["install"], len(j.history.E2eFailures))
+	if phases[""] > 0 {
+		fmt.Printf(", %d unknown", phases[""])
+	}
+	fmt.Println()
+	if len(j.history.InstallFailures) == 0 {
+		return
+	}
+
+	fmt.Printf("\n[%s] Builds with failed installation (%d)\n", j.Name, len(j.history.InstallFailures))
+	for _, f := range j.history.InstallFailures {
+		reason := "failed"
+		if f.TimedOut {
+			reason = "timed out"
+		}
+		phase := f.Phase
+		if phase == "" {
+			phase = "unknown"
+		}
+		fmt.Printf("%s\t%s %s after %s\t%s\n", f.Build, phase, reason, f.Duration.Round(time.Minute), f.Reason)
+	}
+}
+
+// ShowNotAnalyzedBuilds reports the builds that were not analyzed,
+// grouped by the reason why, so that the totals are not misread
+func (j *Job) ShowNotAnalyzedBuilds() {
+	if len(j.history.Skipped) == 0 {
+		return
+	}
+
+	ids := []string{}
+	counts := make(map[string]int)
+	for id := range j.history.Skipped {
+		ids = append(ids, id)
+		counts[j.history.SkipCategories[id]]++
+	}
+	sort.Strings(ids)
+
+	categories := []string{}
+	for c := range counts {
+		categories = append(categories, c)
+	}
+	sort.Slice(categories, func(a, b int) bool {
+		if counts[categories[a]] != counts[categories[b]] {
+			return counts[categories[a]] > counts[categories[b]]
+		}
+		return categories[a] < categories[b]
+	})
+	summary := []string{}
+	for _, c := range categories {
+		summary = append(summary, fmt.Sprintf("%d %s", counts[c], c))
+	}
+
+	fmt.Printf("\n[%s] Not analyzed builds (%d of %.0f): %s\n", j.Name, len(ids), j.history.TotalBuilds+float32(len(ids)), strings.Join(summary, ", "))
+	for _, id := range ids {
+		fmt.Printf("%s\t%-20s%s\n", id, j.history.SkipCategories[id], j.history.Skipped[id])
+	}
+}
+
+// TimeWindow is a time range of analyzed builds, with the Until bound excluded
+type TimeWindow struct {
+	Since time.Time
+	Until time.Time
+}
+
+// ParseWindow reads a time window like 2021-10-01..2021-10-07, where
+// both the dates are included
+func ParseWindow(s string) (TimeWindow, error) {
+	w := TimeWindow{}
+
+	bounds := strings.Split(s, "..")
+	if len(bounds) != 2 {
+		return w, fmt.Errorf("Invalid time window %s, expected <since>..<until>", s)
+	}
+	since, err := time.Parse("2006-01-02", bounds[0])
+	if err != nil {
+		return w, err
+	}
+	until, err := time.Parse("2006-01-02", bounds[1])
+	if err != nil {
+		return w, err
+	}
+	if until.Before(since) {
+		return w, fmt.Errorf("Invalid time window %s, the since date is after the until one", s)
+	}
+
+	w.Since, w.Until = since, until.AddDate(0, 0, 1)
+	return w, nil
+}
+
+func (w TimeWindow) String() string {
+	return fmt.Sprintf("%s..%s", w.Since.Format("2006-01-02"), w.Until.AddDate(0, 0, -1).Format("2006-01-02"))
+}
+
+// ShowWindowsComparison reports the tests of a job whose pass rate or
+// flakiness changed significantly between two time windows, and the
+// ones that started failing in the newest window
+func ShowWindowsComparison(oldJob, newJob *Job, before, after TimeWindow) {
+	type change struct {
+		kind     string
+		test     string
+		passRate string
+		flakes   string
+	}
+
+	minChange := newJob.opts.MinChange
+
+	// Most important changes first
+	order := map[string]int{"new failure": 0, "worse": 1, "better": 2}
+	changes := []change{}
+	newJob.reportTests().ForEach(func(name string, th TestHistory) {
+		nf := newJob.newFlakyTest(name, th)
+		oth, ok := oldJob.reportTests().Get(name)
+		of := oldJob.newFlakyTest(name, oth)
+
+		// Tests not run in the oldest window are shown without values
+		c := change{
+			test:     name,
+			passRate: fmt.Sprintf("- -> %.0f%%", nf.passRate*100),
+			flakes:   fmt.Sprintf("- -> %.2f", nf.flakiness),
+		}
+		if ok {
+			c.passRate = fmt.Sprintf("%.0f%% -> %.0f%%", of.passRate*100, nf.passRate*100)
+			c.flakes = fmt.Sprintf("%.2f -> %.2f", of.flakiness, nf.flakiness)
+		}
+
+		passDelta := float64(nf.passRate - of.passRate)
+		flakesDelta := float64(nf.flakiness - of.flakiness)
+		switch {
+		case th.Failures > 0 && oth.Failures == 0:
+			c.kind = "new failure"
+		case !ok:
+			return
+		case passDelta <= -minChange || flakesDelta >= minChange:
+			c.kind = "worse"
+		case passDelta >= minChange || flakesDelta <= -minChange:
+			c.kind = "better"
+		default:
+			return
+		}
+		changes = append(changes, c)
+	})
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].kind != changes[j].kind {
+			return order[changes[i].kind] < order[changes[j].kind]
+		}
+		return changes[i].test < changes[j].test
+	})
+
+	fmt.Println("-----------------------------------------")
+	fmt.Printf("\n[%s] Changes from %s (%0.f builds) to %s (%0.f builds)\n", newJob.Name, before, oldJob.history.TotalBuilds, after, newJob.history.TotalBuilds)
+	if len(changes) == 0 {
+		fmt.Println("No significant changes found")
+		return
+	}
+	fmt.Printf("%-13s%-16s%-16s%s\n", "CHANGE", "PASS RATE", "FLAKES", "TEST")
+	for _, c := range changes {
+		fmt.Printf("%-13s%-16s%-16s%s\n", c.kind, c.passRate, c.flakes, c.test)
+	}
+}
+
+// TrendPoint summarizes the tests outcomes of the builds finished
+// within the same period
+type TrendPoint struct {
+	start  time.Time
+	builds map[string]bool
+	runs   int
+	passed int
+	// Whether every test passed and failed within the period
+	outcomes map[string][2]bool
+}
+
+// passRate returns the ratio of the tests runs that passed
+func (p *TrendPoint) passRate() float64 {
+	if p.runs == 0 {
+		return 1
+	}
+	return float64(p.passed) / float64(p.runs)
+}
+
+// flakyTests returns how many tests both passed and failed within the period
+func (p *TrendPoint) flakyTests() int {
+	n := 0
+	for _, o := range p.outcomes {
+		if o[0] && o[1] {
+			n++
+		}
+	}
+	return n
+}
+
+// Trend reads the job results, grouping the tests outcomes by period.
+// Only the builds within -since and -until are considered, when set
+func (j *Job) Trend(period time.Duration) ([]*TrendPoint, error) {
+	results, err := j.openResults()
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	// The timestamps are compared as text, "~" sorting after any of them
+	from, to := "", "~"
+	if !j.opts.Since.IsZero() {
+		from = j.opts.Since.UTC().Format(time.RFC3339)
+	}
+	if !j.opts.Until.IsZero() {
+		to = j.opts.Until.UTC().Format(time.RFC3339)
+	}
+	rows, err := results.db.Query(`SELECT timestamp, build, test, outcome FROM results JOIN builds USING (job, build)
+		WHERE job = ? AND timestamp >= ? AND timestamp < ?`, j.Name, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := make(map[time.Time]*TrendPoint)
+	for rows.Next() {
+		var timestamp, build, test, outcome string
+		if err := rows.Scan(&timestamp, &build, &test, &outcome); err != nil {
+			return nil, err
+		}
+
+		if outcome == "skipped" || j.opts.ignoreTest(test) {
+			continue
+		}
+		ts, err := time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		start := ts.Truncate(period)
+		p, ok := points[start]
+		if !ok {
+			p = &TrendPoint{start: start, builds: make(map[string]bool), outcomes: make(map[string][2]bool)}
+			points[start] = p
+		}
+		p.builds[build] = true
+		p.runs++
+		o := p.outcomes[test]
+		if outcome == "passed" {
+			p.passed++
+			o[0] = true
+		} else {
+			o[1] = true
+		}
+		p.outcomes[test] = o
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	trend := []*TrendPoint{}
+	for _, p := range points {
+		trend = append(trend, p)
+	}
+	sort.Slice(trend, func(a, b int) bool {
+		return trend[a].start.Before(trend[b].start)
+	})
+	return trend, nil
+}
+
+// ShowTrend charts the tests pass rate and the number of flaky tests
+// of every period
+func (j *Job) ShowTrend(trend []*TrendPoint) {
+	const width = 40
+
+	maxFlaky := 1
+	for _, p := range trend {
+		if n := p.flakyTests(); n > maxFlaky {
+			maxFlaky = n
+		}
+	}
+
+	fmt.Println("-----------------------------------------")
+	fmt.Printf("\n[%s] Trend\n", j.Name)
+	fmt.Printf("%-18s%-8s%-*s%s\n", "PERIOD", "BUILDS", width+9, "PASS RATE", "FLAKY TESTS")
+	for _, p := range trend {
+		rate := p.passRate()
+		flaky := p.flakyTests()
+		fmt.Printf("%-18s%-8d%-*s%7.2f%%  %-*s %d\n", p.start.Format("2006-01-02 15:04"), len(p.builds),
+			width, strings.Repeat("#", int(math.Round(rate*width))), rate*100,
+			width/2, strings.Repeat("#", int(math.Round(float64(flaky)/float64(maxFlaky)*width/2))), flaky)
+	}
+}
+
+// WriteTrendSvg charts the tests pass rate and the number of flaky tests
+// of every period as a SVG image
+func WriteTrendSvg(w io.Writer, title string, trend []*TrendPoint) error {
+	const width, height, margin = 800.0, 300.0, 40.0
+
+	maxFlaky := 1
+	for _, p := range trend {
+		if n := p.flakyTests(); n > maxFlaky {
+			maxFlaky = n
+		}
+	}
+
+	x := func(i int) float64 {
+		if len(trend) < 2 {
+			return margin
+		}
+		return margin + float64(i)*(width-2*margin)/float64(len(trend)-1)
+	}
+	y := func(v float64) float64 {
+		return height - margin - v*(height-2*margin)
+	}
+	passRate, flaky := []string{}, []string{}
+	for i, p := range trend {
+		passRate = append(passRate, fmt.Sprintf("%.1f,%.1f", x(i), y(p.passRate())))
+		flaky = append(flaky, fmt.Sprintf("%.1f,%.1f", x(i), y(float64(p.flakyTests())/float64(maxFlaky))))
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" font-family="sans-serif" font-size="12">`+"\n", width, height)
+	fmt.Fprintf(bw, `<text x="%.0f" y="20">`, margin)
+	xml.EscapeText(bw, []byte(title))
+	fmt.Fprintf(bw, "</text>\n")
+	fmt.Fprintf(bw, `<line x1="%.0f" y1="%.0f" x2="%.0f" y2="%.0f" stroke="#999"/>`+"\n", margin, y(0), width-margin, y(0))
+	fmt.Fprintf(bw, `<polyline fill="none" stroke="green" stroke-width="2" points="%s"/>`+"\n", strings.Join(passRate, " "))
+	fmt.Fprintf(bw, `<polyline fill="none" stroke="red" stroke-width="2" points="%s"/>`+"\n", strings.Join(flaky, " "))
+	fmt.Fprintf(bw, `<text x="%.0f" y="%.0f" fill="green">pass rate (100%% at the top)</text>`+"\n", margin, height-10)
+	fmt.Fprintf(bw, `<text x="%.0f" y="%.0f" fill="red">flaky tests (%d at the top)</text>`+"\n", width/2, height-10, maxFlaky)
+	if len(trend) > 0 {
+		fmt.Fprintf(bw, `<text x="%.0f" y="%.0f">%s</text>`+"\n", margin, y(0)+15, trend[0].start.Format("2006-01-02"))
+		fmt.Fprintf(bw, `<text x="%.0f" y="%.0f" text-anchor="end">%s</text>`+"\n", width-margin, y(0)+15, trend[len(trend)-1].start.Format("2006-01-02"))
+	}
+	fmt.Fprintf(bw, "</svg>\n")
+	return bw.Flush()
+}
+
+// versionLess orders two x.y release versions
+func versionLess(a, b string) bool {
+	var aMajor, aMinor, bMajor, bMinor int
+	fmt.Sscanf(a, "%d.%d", &aMajor, &aMinor)
+	fmt.Sscanf(b, "%d.%d", &bMajor, &bMinor)
+	if aMajor != bMajor {
+		return aMajor < bMajor
+	}
+	return aMinor < bMinor
+}
+
+// ShowVersionsComparison reports side by side the flakiness of the tests
+// in every version of the same job, highlighting the ones doing worse in
+// the newest version than in all the older ones
+func ShowVersionsComparison(jobs []*Job) {
+	// Jobs are grouped by their name, once the version is removed
+	templates := []string{}
+	byTemplate := make(map[string]map[string]*Job)
+	for _, j := range jobs {
+		if j.Version == "" {
+			continue
+		}
+		t := strings.Replace(j.Name, "-"+j.Version+"-", "-%s-", 1)
+		if _, ok := byTemplate[t]; !ok {
+			templates = append(templates, t)
+			byTemplate[t] = make(map[string]*Job)
+		}
+		byTemplate[t][j.Version] = j
+	}
+
+	for _, t := range templates {
+		versions := []string{}
+		for v := range byTemplate[t] {
+			versions = append(versions, v)
+		}
+		if len(versions) < 2 {
+			continue
+		}
+		sort.Slice(versions, func(i, j int) bool {
+			return versionLess(versions[i], versions[j])
+		})
+
+		// The flakiness of every reported test, for each version where it
+		// was run. Consistently failing tests are considered the worst
+		type cell struct {
+			value    string
+			score    float32
+			reported bool
+		}
+		type row struct {
+			test      string
+			cells     []*cell
+			regressed bool
+		}
+		rows := make(map[string]*row)
+		for i, v := range versions {
+			j := byTemplate[t][v]
+			j.reportTests().ForEach(func(name string, th TestHistory) {
+				r, ok := rows[name]
+				if !ok {
+					r = &row{test: name, cells: make([]*cell, len(versions))}
+					rows[name] = r
+				}
+
+				f := j.newFlakyTest(name, th)
+				c := &cell{value: fmt.Sprintf("%.2f", f.flakiness)}
+				switch {
+				case j.opts.isPermafailing(th):
+					c.value, c.score, c.reported = "fail", 2, true
+				case j.opts.isFlaky(th):
+					c.score = f.flakiness
+					c.reported = float64(f.flakiness) >= j.opts.MinFlakiness
+				}
+				r.cells[i] = c
+			})
+		}
+
+		reported := []*row{}
+		for _, r := range rows {
+			shown := false
+			for _, c := range r.cells {
+				shown = shown || (c != nil && c.reported)
+			}
+			if !shown {
+				continue
+			}
+
+			newest := r.cells[len(versions)-1]
+			if newest != nil && newest.reported {
+				r.regressed = true
+				older := 0
+				for _, c := range r.cells[:len(versions)-1] {
+					if c == nil {
+						continue
+					}
+					older++
+					if c.score >= newest.score {
+						r.regressed = false
+					}
+				}
+				// Tests not run in the older versions cannot regress
+				r.regressed = r.regressed && older > 0
+			}
+			reported = append(reported, r)
+		}
+		sort.Slice(reported, func(i, j int) bool {
+			if reported[i].regressed != reported[j].regressed {
+				return reported[i].regressed
+			}
+			return reported[i].test < reported[j].test
+		})
+
+		fmt.Println("-----------------------------------------")
+		fmt.Printf("\n[%s] Flaky tests across versions\n", t)
+		for _, v := range versions {
+			fmt.Printf("%-8s", v)
+		}
+		fmt.Printf("%-11s%s\n", "REGRESSED", "TEST")
+		for _, r := range reported {
+			for _, c := range r.cells {
+				value := "-"
+				if c != nil {
+					value = c.value
+				}
+				fmt.Printf("%-8s", value)
+			}
+			regressed := ""
+			if r.regressed {
+				regressed = "yes"
+			}
+			fmt.Printf("%-11s%s\n", regressed, r.test)
+		}
+	}
+}
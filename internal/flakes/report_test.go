@@ -0,0 +1,94 @@
+package flakes
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "Update the golden files in testdata")
+
+// checkGolden compares the output with the named golden file in testdata,
+// rewriting it instead when running with -update
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	golden := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("output differs from %s:\n%s", golden, got)
+	}
+}
+
+func TestWriteFlakeRecords(t *testing.T) {
+	records := parseFixtureJob(t).FlakeRecords()
+
+	tests := []struct {
+		format  string
+		golden  string
+		wantErr bool
+	}{
+		{format: "json", golden: "report.json"},
+		{format: "csv", golden: "report.csv"},
+		{format: "yaml", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := WriteFlakeRecords(&buf, tt.format, records)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr {
+				checkGolden(t, tt.golden, buf.Bytes())
+			}
+		})
+	}
+}
+
+func TestWriteMarkdownReport(t *testing.T) {
+	j := parseFixtureJob(t)
+
+	var buf bytes.Buffer
+	if err := WriteMarkdownReport(&buf, []*Job{j}); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "report.md", buf.Bytes())
+}
+
+func TestWriteHtmlReport(t *testing.T) {
+	j := parseFixtureJob(t)
+
+	var buf bytes.Buffer
+	if err := WriteHtmlReport(&buf, []*Job{j}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The report carries its generation time, so only its content is checked
+	for _, expected := range []string{
+		fixtureJob,
+		"[sig-network] Services should serve endpoints",
+		"[sig-node] Pods should be evicted",
+		j.ArtifactsUrl("103"),
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("expected %q in the report", expected)
+		}
+	}
+	if strings.Contains(buf.String(), "[sig-storage] Volumes should be mountable") {
+		t.Error("expected the stable test not to be reported")
+	}
+}
@@ -0,0 +1,714 @@
+// Package gcs downloads the Prow jobs artifacts stored in the GCS bucket,
+// retrying the transient failures and caching them on disk
+package gcs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// This is the url where the Prow jobs artifacts are stored
+	BaseUrl = "https://gcsweb-ci.apps.ci.l2s4.p1.openshiftapps.com/gcs/origin-ci-test/logs"
+	// The GCS JSON API used to list the Prow jobs artifacts
+	ListUrl = "https://storage.googleapis.com/storage/v1/b/origin-ci-test/o"
+)
+
+// BucketUrl returns the url of a path within the artifacts bucket, given
+// one of the urls of the periodic jobs builds, stored under logs
+func BucketUrl(logsUrl string, path string) string {
+	return strings.TrimSuffix(logsUrl, "logs") + path
+}
+
+// errNotCached is returned in offline mode for the files never downloaded before
+var errNotCached = errors.New("not available in the offline cache")
+
+// HttpStatusError is returned when the server replies with an unexpected status
+type HttpStatusError struct {
+	Url        string
+	StatusCode int
+	Status     string
+}
+
+func (e *HttpStatusError) Error() string {
+	return fmt.Sprintf("unable to fetch %s: %s", e.Url, e.Status)
+}
+
+// IsNotFound tells if a download failed because the file does not exist
+func IsNotFound(err error) bool {
+	var se *HttpStatusError
+	return errors.As(err, &se) && se.StatusCode == http.StatusNotFound
+}
+
+// isTransient tells if a failed download is worth retrying. Network errors,
+// server errors and throttling are, while other statuses like 404 are not
+func isTransient(err error) bool {
+	if errors.Is(err, errNotCached) || errors.Is(err, errNotRecorded) {
+		return false
+	}
+
+	var se *HttpStatusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= 500 || se.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// Client downloads the Prow jobs artifacts, and the other files the
+// analysis needs, retrying the transient failures and caching them
+type Client struct {
+	// Sends all the requests to the remote servers: an http.Client, or a
+	// fetcher recording or replaying the responses
+	Fetcher Fetcher
+	// Bearer token sent with every request, for private Prow and GCS endpoints
+	AuthToken string
+	// How many times a failed download is retried before giving up, and
+	// the delay before the first retry, doubled at every further attempt
+	Retries      int
+	RetryBackoff time.Duration
+	// Shared by all the requests, when set
+	Limiter *RateLimiter
+	// Where the downloaded files are cached, nothing being cached when
+	// not set, and for how long they are reused without checking the server
+	CacheDir string
+	CacheTTL time.Duration
+	// If set, only the cached files are used, without any network access
+	Offline bool
+	// How many downloads are run in parallel
+	Concurrency int
+}
+
+// NewClient returns a client with the default options, caching the
+// downloaded files in the given folder
+func NewClient(cacheDir string) *Client {
+	return &Client{
+		Fetcher:      http.DefaultClient,
+		Retries:      3,
+		RetryBackoff: time.Second,
+		CacheDir:     cacheDir,
+		CacheTTL:     time.Hour,
+		Concurrency:  8,
+	}
+}
+
+// retryDelay returns how long to wait before the given retry attempt,
+// doubling the backoff at every attempt and adding a random jitter
+func (c *Client) retryDelay(attempt int) time.Duration {
+	delay := c.RetryBackoff << (attempt - 1)
+	if delay <= 0 {
+		return 0
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// RateLimiter is a token bucket shared by all the outgoing requests, to avoid
+// being throttled by the servers when downloading in parallel
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter allows up to rate requests per second, with bursts of
+// the same size. A non positive rate disables the limit
+func NewRateLimiter(rate float64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(1, math.Ceil(rate))
+	return &RateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until a request could be sent
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	// The token is taken in advance, so that the waiting requests are
+	// served in order
+	l.tokens--
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Fetch downloads the given url, retrying up to Retries times in case
+// of transient failures
+func (c *Client) Fetch(ctx context.Context, url string) ([]byte, error) {
+	var body []byte
+	err := c.withRetries(ctx, url, func() error {
+		r, err := c.openOnce(ctx, url)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		body, err = ioutil.ReadAll(r)
+		return err
+	})
+	return body, err
+}
+
+// Open streams the given url, so that large files do not need to be
+// kept in memory. Only the request is retried, not the reading of the body
+func (c *Client) Open(ctx context.Context, url string) (io.ReadCloser, error) {
+	var body io.ReadCloser
+	err := c.withRetries(ctx, url, func() error {
+		var err error
+		body, err = c.openOnce(ctx, url)
+		return err
+	})
+	return body, err
+}
+
+// withRetries runs fn until it succeeds, retrying up to Retries times
+// in case of transient failures
+func (c *Client) withRetries(ctx context.Context, url string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil || !isTransient(err) {
+			return err
+		}
+		if attempt >= c.Retries {
+			slog.Warn("Giving up", "url", url, "retries", c.Retries, "err", err)
+			return fmt.Errorf("%s (after %d retries)", err, c.Retries)
+		}
+
+		delay := c.retryDelay(attempt + 1)
+		slog.Debug("Retrying", "url", url, "delay", delay.Round(time.Millisecond), "attempt", attempt+1, "retries", c.Retries, "err", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// isProwHost tells if the given host serves the Prow artifacts and the GCS
+// endpoints, the only ones the bearer token is sent to
+func isProwHost(host string) bool {
+	for _, endpoint := range []string{BaseUrl, ListUrl} {
+		if u, err := url.Parse(endpoint); err == nil && u.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// openOnce opens the given url, reusing the cached copy while fresh,
+// and revalidating it with the server once expired
+func (c *Client) openOnce(ctx context.Context, url string) (io.ReadCloser, error) {
+	cached := c.readHttpCache(url)
+	if cached != nil && (c.Offline || time.Since(cached.Fetched) < c.CacheTTL) {
+		return os.Open(c.httpCacheBodyPath(url))
+	}
+	if c.Offline {
+		return nil, fmt.Errorf("%s %w", url, errNotCached)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.AuthToken != "" && isProwHost(req.URL.Host) {
+		req.Header.Set("Authorization", "Bearer "+c.AuthToken)
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	if err := c.Limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	r, err := c.Fetcher.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.StatusCode == http.StatusNotModified && cached != nil {
+		r.Body.Close()
+		cached.Fetched = time.Now()
+		c.writeHttpCache(url, cached)
+		return os.Open(c.httpCacheBodyPath(url))
+	}
+
+	if r.StatusCode != http.StatusOK {
+		r.Body.Close()
+		return nil, &HttpStatusError{
+			Url:        url,
+			StatusCode: r.StatusCode,
+			Status:     r.Status,
+		}
+	}
+
+	return c.newCachingReader(url, r), nil
+}
+
+// cachingReader copies the response body into the cache while it's read,
+// storing it only once it has been read completely
+type cachingReader struct {
+	client *Client
+	url    string
+	entry  httpCacheEntry
+	body   io.ReadCloser
+	tmp    *os.File
+	done   bool
+}
+
+func (client *Client) newCachingReader(url string, r *http.Response) *cachingReader {
+	c := &cachingReader{
+		client: client,
+		url:    url,
+		entry: httpCacheEntry{
+			ETag:         r.Header.Get("ETag"),
+			LastModified: r.Header.Get("Last-Modified"),
+			Fetched:      time.Now(),
+		},
+		body: r.Body,
+	}
+
+	// The body is still returned if it cannot be cached
+	if client.CacheDir == "" {
+		return c
+	}
+	name := client.httpCacheBodyPath(url)
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err == nil {
+		c.tmp, err = ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	}
+	if err != nil {
+		slog.Warn("Error while caching", "url", url, "err", err)
+	}
+
+	return c
+}
+
+func (c *cachingReader) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	if c.tmp != nil && n > 0 {
+		if _, werr := c.tmp.Write(p[:n]); werr != nil {
+			slog.Warn("Error while caching", "url", c.url, "err", werr)
+			c.discard()
+		}
+	}
+	if err == io.EOF {
+		c.done = true
+	}
+	return n, err
+}
+
+func (c *cachingReader) Close() error {
+	err := c.body.Close()
+	if c.tmp == nil {
+		return err
+	}
+	if !c.done {
+		c.discard()
+		return err
+	}
+
+	tmp := c.tmp.Name()
+	cerr := c.tmp.Close()
+	if cerr == nil {
+		cerr = os.Rename(tmp, c.client.httpCacheBodyPath(c.url))
+	}
+	if cerr != nil {
+		slog.Warn("Error while caching", "url", c.url, "err", cerr)
+		os.Remove(tmp)
+		return err
+	}
+	c.client.writeHttpCache(c.url, &c.entry)
+
+	return err
+}
+
+// discard drops the partially cached body
+func (c *cachingReader) discard() {
+	c.tmp.Close()
+	os.Remove(c.tmp.Name())
+	c.tmp = nil
+}
+
+// NewHttpClient returns a client trusting also the certificates
+// found in the given PEM bundle
+func NewHttpClient(caBundle string) (*http.Client, error) {
+	pem, err := ioutil.ReadFile(caBundle)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No valid certificates found in %s", caBundle)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs: pool,
+	}
+
+	return &http.Client{
+		Transport: transport,
+	}, nil
+}
+
+// Fetcher sends a request to a remote server, like http.Client does
+type Fetcher interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// errNotRecorded is returned in replay mode for the requests never recorded
+var errNotRecorded = errors.New("not available in the recorded fixtures")
+
+// fixture describes a recorded response. The body is stored aside, as is
+type fixture struct {
+	Method     string      `json:"method"`
+	Url        string      `json:"url"`
+	StatusCode int         `json:"statusCode"`
+	Status     string      `json:"status"`
+	Header     http.Header `json:"header"`
+}
+
+// fixturePath returns where the response to the given request is recorded.
+// The credentials are redacted from the url, so that the fixtures could be
+// replayed with any of them
+func fixturePath(dir string, req *http.Request) string {
+	key := req.Method + " " + redactUrl(req.URL)
+	return filepath.Join(dir, fmt.Sprintf("%x", sha1.Sum([]byte(key))))
+}
+
+var secretParamRe = regexp.MustCompile(`(?i)token|key|secret|password|signature|sig$`)
+
+// redactUrl hides the credentials found in the given url, so that they
+// are never stored in the fixtures
+func redactUrl(u *url.URL) string {
+	redacted := *u
+	if redacted.User != nil {
+		redacted.User = url.User("REDACTED")
+	}
+	query := redacted.Query()
+	for k := range query {
+		if secretParamRe.MatchString(k) {
+			query.Set(k, "REDACTED")
+		}
+	}
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+// RecordingFetcher stores the responses to the GET requests sent through
+// next as fixtures, so that the same requests could be replayed later.
+// Other requests, like the notifications, are sent without being recorded,
+// since their urls and bodies may carry secrets
+type RecordingFetcher struct {
+	Next Fetcher
+	Dir  string
+}
+
+// Do sends the request, recording the response. The body is read
+// completely before being returned, since it's stored as well
+func (f *RecordingFetcher) Do(req *http.Request) (*http.Response, error) {
+	resp, err := f.Next.Do(req)
+	if err != nil || req.Method != http.MethodGet {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	name := fixturePath(f.Dir, req)
+	err = WriteFileAtomically(name+".body", func(w io.Writer) error {
+		_, err := w.Write(body)
+		return err
+	})
+	if err == nil {
+		err = WriteFileAtomically(name+".json", func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(fixture{
+				Method:     req.Method,
+				Url:        redactUrl(req.URL),
+				StatusCode: resp.StatusCode,
+				Status:     resp.Status,
+				Header:     redactHeader(resp.Header),
+			})
+		})
+	}
+	if err != nil {
+		slog.Warn("Error while recording", "url", req.URL, "err", err)
+	}
+
+	return resp, nil
+}
+
+// redactHeader drops the response headers that may carry credentials
+func redactHeader(h http.Header) http.Header {
+	redacted := h.Clone()
+	redacted.Del("Set-Cookie")
+	redacted.Del("Authorization")
+	return redacted
+}
+
+// ReplayingFetcher serves the responses recorded by a RecordingFetcher,
+// without any network access. Only GET requests could be replayed
+type ReplayingFetcher struct {
+	Dir string
+}
+
+func (f *ReplayingFetcher) Do(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return nil, fmt.Errorf("%s %s %w", req.Method, req.URL, errNotRecorded)
+	}
+	name := fixturePath(f.Dir, req)
+	data, err := ioutil.ReadFile(name + ".json")
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s %s %w", req.Method, req.URL, errNotRecorded)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fx := fixture{}
+	if err := json.Unmarshal(data, &fx); err != nil {
+		return nil, fmt.Errorf("corrupted fixture for %s: %w", req.URL, err)
+	}
+
+	body, err := os.Open(name + ".body")
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:     fx.Status,
+		StatusCode: fx.StatusCode,
+		Header:     fx.Header,
+		Body:       body,
+		Request:    req,
+	}, nil
+}
+
+// httpCacheEntry describes a downloaded file kept in the local cache.
+// The file content is stored aside, so that it could be streamed
+type httpCacheEntry struct {
+	ETag         string
+	LastModified string
+	Fetched      time.Time
+}
+
+// DefaultCacheDir returns the platform cache folder for the tool,
+// i.e. $XDG_CACHE_HOME/metal-ipi-releases on Linux
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ".metal-ipi-releases"
+	}
+	return filepath.Join(dir, "metal-ipi-releases")
+}
+
+func (c *Client) httpCachePath(url string) string {
+	return filepath.Join(c.CacheDir, fmt.Sprintf("%x", sha1.Sum([]byte(url))))
+}
+
+func (c *Client) httpCacheBodyPath(url string) string {
+	return c.httpCachePath(url) + ".body"
+}
+
+// readHttpCache returns the cached copy of the given url, if any
+func (c *Client) readHttpCache(url string) *httpCacheEntry {
+	if c.CacheDir == "" {
+		return nil
+	}
+	f, err := os.Open(c.httpCachePath(url))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	entry := httpCacheEntry{}
+	err = gob.NewDecoder(bufio.NewReader(f)).Decode(&entry)
+	if err != nil {
+		slog.Warn("Ignoring corrupted cache entry", "url", url, "err", err)
+		return nil
+	}
+	if _, err := os.Stat(c.httpCacheBodyPath(url)); err != nil {
+		return nil
+	}
+
+	return &entry
+}
+
+// writeHttpCache stores the given url details in the cache
+func (c *Client) writeHttpCache(url string, entry *httpCacheEntry) {
+	err := WriteFileAtomically(c.httpCachePath(url), func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(entry)
+	})
+	if err != nil {
+		slog.Warn("Error while caching", "url", url, "err", err)
+	}
+}
+
+// WriteFileAtomically writes a file through a temporary one, renamed only
+// once completed, so that an interruption never leaves it half-written
+func WriteFileAtomically(name string, write func(w io.Writer) error) error {
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
+
+// ForEachParallel calls fn for every index in [0, n), running
+// at most Concurrency calls at the same time
+func (c *Client) ForEachParallel(n int, fn func(i int)) {
+	limit := c.Concurrency
+	if limit < 1 {
+		limit = 1
+	}
+
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Listing is a page of the GCS objects listing, as returned by ListUrl
+type Listing struct {
+	Prefixes []string `json:"prefixes"`
+	Items    []struct {
+		Name string `json:"name"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+// ListFolder returns the subfolders and the files directly contained in
+// the given artifacts folder url (under BaseUrl), using the GCS JSON API
+func (c *Client) ListFolder(ctx context.Context, folderUrl string) ([]string, []string, error) {
+	prefix := strings.TrimPrefix(folderUrl, BucketUrl(BaseUrl, ""))
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	folders := []string{}
+	files := []string{}
+	pageToken := ""
+	for {
+		query := url.Values{}
+		query.Set("prefix", prefix)
+		query.Set("delimiter", "/")
+		query.Set("fields", "prefixes,items(name),nextPageToken")
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		body, err := c.Fetch(ctx, fmt.Sprintf("%s?%s", ListUrl, query.Encode()))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		listing := Listing{}
+		err = json.Unmarshal(body, &listing)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, p := range listing.Prefixes {
+			folders = append(folders, path.Base(p))
+		}
+		for _, i := range listing.Items {
+			files = append(files, path.Base(i.Name))
+		}
+
+		if listing.NextPageToken == "" {
+			break
+		}
+		pageToken = listing.NextPageToken
+	}
+
+	return folders, files, nil
+}
@@ -0,0 +1,218 @@
+// Package junit reads the junit files published by the Prow jobs builds
+package junit
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/andfasano/metal-ipi-releases/internal/gcs"
+)
+
+type TestCaseSkipped struct {
+	XMLName xml.Name `xml:"skipped"`
+	Message string   `xml:"message,attr"`
+}
+
+// TestCase keeps only what's needed of a junit test case: its output is
+// never read, and it's discarded while decoding
+type TestCase struct {
+	XMLName xml.Name        `xml:"testcase"`
+	Name    string          `xml:"name,attr"`
+	Time    float64         `xml:"time,attr"`
+	Skipped TestCaseSkipped `xml:"skipped"`
+	Failure string          `xml:"failure"`
+}
+
+func (tc *TestCase) IsSkipped() bool {
+	return tc.Skipped.Message != ""
+}
+
+func (tc *TestCase) IsFailure() bool {
+	return tc.Failure != ""
+}
+
+func (tc *TestCase) IsPassed() bool {
+	return !tc.IsFailure()
+}
+
+type TestProperty struct {
+	XMLName xml.Name `xml:"property"`
+	Name    string   `xml:"name,attr"`
+	Value   string   `xml:"value,attr"`
+}
+
+type TestSuite struct {
+	XMLName  xml.Name `xml:"testsuite"`
+	Name     string   `xml:"name,attr"`
+	Tests    int      `xml:"tests,attr"`
+	Skipped  int      `xml:"skipped,attr"`
+	Failures int      `xml:"failures,attr"`
+	Time     float64  `xml:"time,attr"`
+
+	Property TestProperty `xml:"property"`
+
+	TestCases []TestCase `xml:"testcase"`
+}
+
+// CollapseRetries merges the test cases run more than once within the
+// suite, as openshift-tests does when retrying the failed tests. A test
+// passing in any of its attempts is considered passed, and returned among
+// the in-run flakes when another attempt failed
+func (ts *TestSuite) CollapseRetries() map[string]bool {
+	inRunFlakes := make(map[string]bool)
+	merged := make(map[string]int)
+	testCases := []TestCase{}
+	for _, tc := range ts.TestCases {
+		i, ok := merged[tc.Name]
+		if !ok {
+			merged[tc.Name] = len(testCases)
+			testCases = append(testCases, tc)
+			continue
+		}
+
+		prev := &testCases[i]
+		switch {
+		case tc.IsSkipped():
+		case prev.IsSkipped():
+			*prev = tc
+		case prev.IsFailure() != tc.IsFailure():
+			inRunFlakes[tc.Name] = true
+			if prev.IsFailure() {
+				*prev = tc
+			}
+		}
+	}
+
+	ts.TestCases = testCases
+	return inRunFlakes
+}
+
+// Fetch downloads a single junit file, transparently decompressing
+// it when gzipped
+func Fetch(ctx context.Context, c *gcs.Client, url string) (*TestSuite, error) {
+	body, err := c.Open(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	br := bufio.NewReader(body)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	return Decode(r)
+}
+
+// Decode parses a junit file one test case at a time, without loading
+// the whole document in memory
+func Decode(r io.Reader) (*TestSuite, error) {
+	testSuite := TestSuite{}
+	found := false
+
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		se, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch se.Name.Local {
+		case "testsuite":
+			if found {
+				continue
+			}
+			found = true
+			testSuite.XMLName = se.Name
+			for _, attr := range se.Attr {
+				switch attr.Name.Local {
+				case "name":
+					testSuite.Name = attr.Value
+				case "tests":
+					testSuite.Tests, _ = strconv.Atoi(attr.Value)
+				case "skipped":
+					testSuite.Skipped, _ = strconv.Atoi(attr.Value)
+				case "failures":
+					testSuite.Failures, _ = strconv.Atoi(attr.Value)
+				case "time":
+					testSuite.Time, _ = strconv.ParseFloat(attr.Value, 64)
+				}
+			}
+		case "property":
+			if err := decoder.DecodeElement(&testSuite.Property, &se); err != nil {
+				return nil, err
+			}
+		case "testcase":
+			tc, err := decodeTestCase(decoder, se)
+			if err != nil {
+				return nil, err
+			}
+			testSuite.TestCases = append(testSuite.TestCases, tc)
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("No test suite found")
+	}
+
+	return &testSuite, nil
+}
+
+// decodeTestCase reads the test case started by se, skipping its output
+// and any other element not used, so that only the failure message is
+// ever kept in memory, and only for the failed cases
+func decodeTestCase(decoder *xml.Decoder, se xml.StartElement) (TestCase, error) {
+	tc := TestCase{XMLName: se.Name}
+	for _, attr := range se.Attr {
+		switch attr.Name.Local {
+		case "name":
+			tc.Name = attr.Value
+		case "time":
+			tc.Time, _ = strconv.ParseFloat(attr.Value, 64)
+		}
+	}
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return tc, err
+		}
+
+		switch t := token.(type) {
+		case xml.EndElement:
+			return tc, nil
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "skipped":
+				err = decoder.DecodeElement(&tc.Skipped, &t)
+			case "failure":
+				err = decoder.DecodeElement(&tc.Failure, &t)
+			default:
+				err = decoder.Skip()
+			}
+			if err != nil {
+				return tc, err
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package junit
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCollapseRetries(t *testing.T) {
+	passed := func(name string) TestCase {
+		return TestCase{Name: name}
+	}
+	failed := func(name string) TestCase {
+		return TestCase{Name: name, Failure: "fail"}
+	}
+	skipped := func(name string) TestCase {
+		return TestCase{Name: name, Skipped: TestCaseSkipped{Message: "skip"}}
+	}
+
+	tests := []struct {
+		name        string
+		testCases   []TestCase
+		expected    []TestCase
+		inRunFlakes map[string]bool
+	}{
+		{
+			name:        "no retries",
+			testCases:   []TestCase{passed("a"), failed("b")},
+			expected:    []TestCase{passed("a"), failed("b")},
+			inRunFlakes: map[string]bool{},
+		},
+		{
+			name:        "passed when retried",
+			testCases:   []TestCase{failed("a"), passed("b"), passed("a")},
+			expected:    []TestCase{passed("a"), passed("b")},
+			inRunFlakes: map[string]bool{"a": true},
+		},
+		{
+			name:        "failed when retried",
+			testCases:   []TestCase{passed("a"), failed("a")},
+			expected:    []TestCase{passed("a")},
+			inRunFlakes: map[string]bool{"a": true},
+		},
+		{
+			name:        "always failing",
+			testCases:   []TestCase{failed("a"), failed("a"), failed("a")},
+			expected:    []TestCase{failed("a")},
+			inRunFlakes: map[string]bool{},
+		},
+		{
+			name:        "skipped attempts",
+			testCases:   []TestCase{skipped("a"), failed("a"), skipped("a")},
+			expected:    []TestCase{failed("a")},
+			inRunFlakes: map[string]bool{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := &TestSuite{TestCases: tt.testCases}
+			inRunFlakes := ts.CollapseRetries()
+			if !reflect.DeepEqual(ts.TestCases, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, ts.TestCases)
+			}
+			if !reflect.DeepEqual(inRunFlakes, tt.inRunFlakes) {
+				t.Errorf("expected in-run flakes %v, got %v", tt.inRunFlakes, inRunFlakes)
+			}
+		})
+	}
+}
@@ -0,0 +1,597 @@
+package prow
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andfasano/metal-ipi-releases/internal/gcs"
+	"github.com/andfasano/metal-ipi-releases/internal/junit"
+)
+
+// Every job will publish a finished.json artifact when completed
+type Finished struct {
+	Timestamp int64  `json:"timestamp"`
+	Passed    bool   `json:"passed"`
+	Result    string `json:"result"`
+	Revision  string `json:"revision"`
+}
+
+type Build struct {
+	// The job owner of this build
+	Job *Job
+	// The unique build id
+	Id string
+	// The end status of the build
+	Finished Finished
+	// A link to the build artifacts
+	ArtifactsUrl string
+}
+
+// prowJob is the subset of the Prow job definition of a build needed
+// to find the payloads used by the upgrade jobs
+type prowJob struct {
+	Spec struct {
+		PodSpec struct {
+			Containers []struct {
+				Env []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"env"`
+			} `json:"containers"`
+		} `json:"pod_spec"`
+	} `json:"spec"`
+}
+
+var (
+	upgradeFromRe   = regexp.MustCompile(`upgrade-from-(?:stable-)?(\d+\.\d+)`)
+	stableVersionRe = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+	minorVersionRe  = regexp.MustCompile(`^\d+\.\d+`)
+)
+
+// upgradeEdgeVersion shortens a payload tag to the version shown in the
+// upgrade edges: stable releases are kept as they are, while only the
+// minor version of the nightly and ci payloads is used
+func upgradeEdgeVersion(tag string) string {
+	if stableVersionRe.MatchString(tag) {
+		return tag
+	}
+	if m := minorVersionRe.FindString(tag); m != "" {
+		return m
+	}
+	return tag
+}
+
+// FetchUpgradeEdge returns the source and target versions of an upgrade
+// build, like 4.9.8 -> 4.10. The payloads are read from the release images
+// set by the release controller, falling back on the job name
+func (b *Build) FetchUpgradeEdge(ctx context.Context) string {
+	from, to := "", b.Job.Version
+	if m := upgradeFromRe.FindStringSubmatch(b.Job.Name); m != nil {
+		from = m[1]
+	} else {
+		from = b.Job.Version
+	}
+
+	url := fmt.Sprintf("%s/prowjob.json", b.Job.ArtifactsUrl(b.Id))
+	body, err := b.Job.Client.Fetch(ctx, url)
+	if err == nil {
+		pj := prowJob{}
+		if err := json.Unmarshal(body, &pj); err == nil {
+			for _, c := range pj.Spec.PodSpec.Containers {
+				for _, env := range c.Env {
+					tag := env.Value[strings.LastIndex(env.Value, ":")+1:]
+					switch env.Name {
+					case "RELEASE_IMAGE_INITIAL":
+						from = upgradeEdgeVersion(tag)
+					case "RELEASE_IMAGE_LATEST":
+						to = upgradeEdgeVersion(tag)
+					}
+				}
+			}
+		}
+	}
+
+	return fmt.Sprintf("%s -> %s", from, to)
+}
+
+// fetchStepResult retrieves the end status of the specified workflow step
+func (b *Build) fetchStepResult(ctx context.Context, step string) (Finished, error) {
+	finished := Finished{}
+
+	url := fmt.Sprintf("%s/%s/finished.json", b.ArtifactsUrl, step)
+	body, err := b.Job.Client.Fetch(ctx, url)
+	if err != nil {
+		return finished, err
+	}
+
+	err = json.Unmarshal(body, &finished)
+	if err != nil {
+		return finished, err
+	}
+
+	return finished, nil
+}
+
+func (b *Build) FetchTestStepResult(ctx context.Context) error {
+	finished, err := b.fetchStepResult(ctx, b.Job.Layout.TestStep)
+	if err != nil {
+		return err
+	}
+
+	b.Finished = finished
+	return nil
+}
+
+// Why a build could not be analyzed
+const (
+	SkipRunning     = "still running"
+	SkipAborted     = "aborted"
+	SkipInfra       = "infra failure"
+	SkipStepName    = "different step name"
+	SkipInstall     = "installation failed"
+	SkipNoTests     = "no test results"
+	SkipUnreachable = "unreachable"
+)
+
+// MissingTestStep tells why the build has no test step result: either
+// the build did not end yet, was aborted, stopped because of an
+// infrastructure error before the tests, or ran them in a step with
+// another name
+func (b *Build) MissingTestStep(ctx context.Context) (string, error) {
+	step := b.Job.Layout.TestStep
+	body, err := b.Job.Client.Fetch(ctx, fmt.Sprintf("%s/finished.json", b.Job.ArtifactsUrl(b.Id)))
+	if gcs.IsNotFound(err) {
+		return SkipRunning, errors.New("the build did not finish yet")
+	}
+	finished := Finished{}
+	if err == nil {
+		err = json.Unmarshal(body, &finished)
+	}
+	if err != nil {
+		return SkipUnreachable, fmt.Errorf("test step %s not found, unable to tell why: %w", step, err)
+	}
+
+	switch finished.Result {
+	case "ABORTED":
+		return SkipAborted, fmt.Errorf("the build was aborted before running %s", step)
+	case "ERROR":
+		return SkipInfra, fmt.Errorf("the build errored before running %s", step)
+	}
+
+	steps, _, err := b.Job.Client.ListFolder(ctx, b.ArtifactsUrl)
+	if err != nil {
+		return SkipUnreachable, fmt.Errorf("test step %s not found, unable to tell why: %w", step, err)
+	}
+	others := []string{}
+	for _, s := range steps {
+		if strings.Contains(s, "e2e") {
+			others = append(others, s)
+		}
+	}
+	if len(others) > 0 {
+		return SkipStepName, fmt.Errorf("test step %s not found, the build has %s", step, strings.Join(others, ", "))
+	}
+	if len(steps) == 0 {
+		return SkipInfra, errors.New("no workflow step ran")
+	}
+	return SkipInfra, fmt.Errorf("the build failed before running %s", step)
+}
+
+// TeardownFailed checks if the cluster deprovisioning failed for the
+// current build. A missing teardown result is not considered a failure
+func (b *Build) TeardownFailed(ctx context.Context) bool {
+	finished, err := b.fetchStepResult(ctx, b.Job.Layout.TeardownStep)
+	if err != nil {
+		return false
+	}
+
+	return !finished.Passed
+}
+
+// Looking up the test filenames, since they contain a timestamp. Results
+// could be split across several files, optionally compressed
+func (b *Build) getTestsXmlFilenames(ctx context.Context, testsUrl string) ([]string, error) {
+	_, files, err := b.Job.Client.ListFolder(ctx, testsUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	urls := []string{}
+	re := regexp.MustCompile(`^junit_.*\.xml(\.gz)?$`)
+	for _, f := range files {
+		if re.MatchString(f) {
+			urls = append(urls, fmt.Sprintf("%s%s", testsUrl, f))
+		}
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("Test file not found or missing")
+	}
+
+	return urls, nil
+}
+
+// FetchTestsXml retrieve the junit xml tests for the current build,
+// merging all the junit files found
+func (b *Build) FetchTestsXml(ctx context.Context) (*junit.TestSuite, error) {
+
+	// Older releases and some job variants store the junit files
+	// in a different folder than the configured one
+	var testXmlUrls []string
+	var err error
+	for i, dir := range []string{b.Job.Layout.JunitDir, "artifacts/junit", "artifacts"} {
+		if i > 0 && dir == b.Job.Layout.JunitDir {
+			continue
+		}
+		testsUrl := fmt.Sprintf("%s/%s/%s/", b.ArtifactsUrl, b.Job.Layout.TestStep, dir)
+		testXmlUrls, err = b.getTestsXmlFilenames(ctx, testsUrl)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var testSuite *junit.TestSuite
+	for _, url := range testXmlUrls {
+		ts, err := junit.Fetch(ctx, b.Job.Client, url)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", url, err)
+		}
+
+		if testSuite == nil {
+			testSuite = ts
+			continue
+		}
+		testSuite.Tests += ts.Tests
+		testSuite.Skipped += ts.Skipped
+		testSuite.Failures += ts.Failures
+		testSuite.Time += ts.Time
+		testSuite.TestCases = append(testSuite.TestCases, ts.TestCases...)
+	}
+
+	return testSuite, nil
+}
+
+// InstallFailure keeps track of a build where the cluster installation failed
+type InstallFailure struct {
+	Build    string
+	Duration time.Duration
+	TimedOut bool
+	// Either bootstrap or install, empty when the installer log is missing
+	Phase  string
+	Reason string
+}
+
+// StepResult is the outcome of a workflow step of a build
+type StepResult struct {
+	Passed bool
+	// Not known when the junit report generated by ci-operator is missing
+	Duration time.Duration
+}
+
+// FetchStepResults retrieves the outcome of every workflow step, and how
+// long it lasted, using the junit report generated by ci-operator. When
+// the report is missing, the finished.json file of every step is used
+func (b *Build) FetchStepResults(ctx context.Context) (map[string]StepResult, error) {
+	url := fmt.Sprintf("%s/artifacts/junit_operator.xml", b.Job.ArtifactsUrl(b.Id))
+	body, err := b.Job.Client.Fetch(ctx, url)
+	if err != nil {
+		if gcs.IsNotFound(err) {
+			return b.fetchStepFinishedResults(ctx)
+		}
+		return nil, err
+	}
+
+	suite := junit.TestSuite{}
+	err = xml.Unmarshal(body, &suite)
+	if err != nil {
+		return nil, err
+	}
+
+	// Step test cases are named like "Run multi-stage test <test> - <test>-<step> container test"
+	re := regexp.MustCompile(fmt.Sprintf(` - %s-(\S+) container test`, regexp.QuoteMeta(b.Job.SafeName)))
+	results := make(map[string]StepResult)
+	for _, tc := range suite.TestCases {
+		if m := re.FindStringSubmatch(tc.Name); m != nil {
+			results[m[1]] = StepResult{
+				Passed:   tc.IsPassed(),
+				Duration: time.Duration(tc.Time * float64(time.Second)),
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// fetchStepFinishedResults retrieves the outcome of every workflow step
+// from the finished.json file found in its artifacts folder
+func (b *Build) fetchStepFinishedResults(ctx context.Context) (map[string]StepResult, error) {
+	steps, _, err := b.Job.Client.ListFolder(ctx, b.ArtifactsUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]StepResult)
+	for _, step := range steps {
+		finished, err := b.fetchStepResult(ctx, step)
+		if err != nil {
+			// Not a step folder, or a step still running
+			continue
+		}
+		results[step] = StepResult{Passed: finished.Passed}
+	}
+
+	return results, nil
+}
+
+// fetchStepDuration retrieves how long the specified workflow step lasted
+func (b *Build) fetchStepDuration(ctx context.Context, step string) (time.Duration, error) {
+	results, err := b.FetchStepResults(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	r, ok := results[step]
+	if !ok || r.Duration == 0 {
+		return 0, fmt.Errorf("Step %s duration not found", step)
+	}
+
+	return r.Duration, nil
+}
+
+// FetchDuration retrieves how long the whole build lasted, from the
+// timestamps of its started.json and finished.json files
+func (b *Build) FetchDuration(ctx context.Context) (time.Duration, error) {
+	timestamp := func(name string) (int64, error) {
+		body, err := b.Job.Client.Fetch(ctx, fmt.Sprintf("%s/%s", b.Job.ArtifactsUrl(b.Id), name))
+		if err != nil {
+			return 0, err
+		}
+		data := struct {
+			Timestamp int64 `json:"timestamp"`
+		}{}
+		if err := json.Unmarshal(body, &data); err != nil {
+			return 0, err
+		}
+		return data.Timestamp, nil
+	}
+
+	started, err := timestamp("started.json")
+	if err != nil {
+		return 0, err
+	}
+	finished, err := timestamp("finished.json")
+	if err != nil {
+		return 0, err
+	}
+	if finished < started {
+		return 0, fmt.Errorf("Build %s finished before starting", b.Id)
+	}
+	return time.Duration(finished-started) * time.Second, nil
+}
+
+// FailureRule labels the failed builds whose logs match any of its patterns
+type FailureRule struct {
+	label    string
+	patterns []*regexp.Regexp
+}
+
+// ParseFailureRules compiles the known failure signatures, given as lists
+// of regular expressions keyed by label, e.g.
+//
+//	infra:
+//	  - 'ironic introspection timed out'
+//	capacity:
+//	  - 'Failed to provision host'
+func ParseFailureRules(config map[string][]string) ([]FailureRule, error) {
+	rules := []FailureRule{}
+	for label, values := range config {
+		rule := FailureRule{label: label}
+		for _, v := range values {
+			re, err := regexp.Compile(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern for %s: %w", label, err)
+			}
+			rule.patterns = append(rule.patterns, re)
+		}
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].label < rules[j].label
+	})
+	return rules, nil
+}
+
+// MatchFailureRules scans the build logs, the ones of the install and of
+// the test steps included, returning the labels of the matching rules
+func (b *Build) MatchFailureRules(ctx context.Context, rules []FailureRule) ([]string, error) {
+	urls := []string{
+		fmt.Sprintf("%s/build-log.txt", b.Job.ArtifactsUrl(b.Id)),
+		fmt.Sprintf("%s/%s/build-log.txt", b.ArtifactsUrl, b.Job.Layout.InstallStep),
+		fmt.Sprintf("%s/%s/build-log.txt", b.ArtifactsUrl, b.Job.Layout.TestStep),
+	}
+
+	matched := make(map[string]bool)
+	for _, url := range urls {
+		body, err := b.Job.Client.Open(ctx, url)
+		if err != nil {
+			if gcs.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() && len(matched) < len(rules) {
+			line := scanner.Text()
+			for _, r := range rules {
+				if matched[r.label] {
+					continue
+				}
+				for _, re := range r.patterns {
+					if re.MatchString(line) {
+						matched[r.label] = true
+						break
+					}
+				}
+			}
+		}
+		err = scanner.Err()
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	labels := []string{}
+	for _, r := range rules {
+		if matched[r.label] {
+			labels = append(labels, r.label)
+		}
+	}
+	return labels, nil
+}
+
+var (
+	// The logs of the baremetal-operator and of the ironic containers
+	metal3PodLogRe = regexp.MustCompile(`^openshift-machine-api_metal3-.*_(metal3-baremetal-operator|metal3-ironic.*|ironic.*)\.log$`)
+	logErrorRe     = regexp.MustCompile(`(?i)\berror\b|"level":"error"|level=error`)
+
+	// The categories of the provisioning errors, checked in order
+	provisioningErrorCategories = []struct {
+		category string
+		re       *regexp.Regexp
+	}{
+		{"BMC timeout", regexp.MustCompile(`(?i)(bmc|ipmi|redfish|idrac|ilo).*(timed? ?out|timeout|unreachable|connection refused|no route to host)`)},
+		{"image download", regexp.MustCompile(`(?i)(image|download|checksum).*(fail|error)|failed to (download|fetch)`)},
+		{"introspection", regexp.MustCompile(`(?i)introspection|inspection`)},
+		{"power management", regexp.MustCompile(`(?i)power (on|off|state)|set_power_state|reboot`)},
+		{"cleaning", regexp.MustCompile(`(?i)clean(ing)?[ _-]?(fail|step|error)`)},
+		{"deployment", regexp.MustCompile(`(?i)deploy`)},
+	}
+)
+
+// provisioningErrorCategory returns the category of an error logged by
+// the metal3 pods, or "other" when unknown
+func provisioningErrorCategory(line string) string {
+	for _, c := range provisioningErrorCategories {
+		if c.re.MatchString(line) {
+			return c.category
+		}
+	}
+	return "other"
+}
+
+// FetchProvisioningErrors scans the metal3 pods logs collected by the
+// gather-extra step, returning the newest error found for every category
+func (b *Build) FetchProvisioningErrors(ctx context.Context) (map[string]string, error) {
+	podsUrl := fmt.Sprintf("%s/%s", b.ArtifactsUrl, b.Job.Layout.PodLogsDir)
+	_, files, err := b.Job.Client.ListFolder(ctx, podsUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]string)
+	for _, f := range files {
+		if !metal3PodLogRe.MatchString(f) {
+			continue
+		}
+		body, err := b.Job.Client.Open(ctx, fmt.Sprintf("%s/%s", podsUrl, f))
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if logErrorRe.MatchString(line) {
+				found[provisioningErrorCategory(line)] = strings.TrimSpace(line)
+			}
+		}
+		err = scanner.Err()
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return found, nil
+}
+
+// FetchInstallFailure checks if the build installation step failed,
+// distinguishing the ones lasting longer than timeout
+func (b *Build) FetchInstallFailure(ctx context.Context, timeout time.Duration) *InstallFailure {
+	finished, err := b.fetchStepResult(ctx, b.Job.Layout.InstallStep)
+	if err != nil || finished.Passed {
+		return nil
+	}
+
+	failure := &InstallFailure{
+		Build: b.Id,
+	}
+	failure.Phase, failure.Reason, err = b.fetchInstallPhase(ctx)
+	if err != nil {
+		slog.Warn("Unable to classify the install failure", "job", b.Job.Name, "build", b.Id, "err", err)
+	}
+	duration, err := b.fetchStepDuration(ctx, b.Job.Layout.InstallStep)
+	if err != nil {
+		slog.Warn("Unable to get the install duration", "job", b.Job.Name, "build", b.Id, "err", err)
+	} else {
+		failure.Duration = duration
+		failure.TimedOut = duration >= timeout
+	}
+
+	return failure
+}
+
+var installErrorRe = regexp.MustCompile(`level=(?:error|fatal) msg="?(.*?)"?$`)
+
+// fetchInstallPhase reads the installer log, to tell whether the cluster
+// installation failed before the bootstrap completed or later, while
+// waiting for the cluster operators. The last error found is the reason
+func (b *Build) fetchInstallPhase(ctx context.Context) (string, string, error) {
+	url := fmt.Sprintf("%s/%s/%s", b.ArtifactsUrl, b.Job.Layout.InstallStep, b.Job.Layout.InstallLog)
+	body, err := b.Job.Client.Open(ctx, url)
+	if err != nil {
+		return "", "", err
+	}
+	defer body.Close()
+
+	phase, reason := "bootstrap", ""
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, "Bootstrap status: complete") || strings.Contains(line, "Destroying the bootstrap resources") {
+			phase = "install"
+		}
+		if m := installErrorRe.FindStringSubmatch(line); m != nil {
+			reason = m[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+
+	return phase, reason, nil
+}
+
+func NewBuild(id string, job *Job) *Build {
+	return &Build{
+		Id:           id,
+		Job:          job,
+		ArtifactsUrl: fmt.Sprintf("%s/artifacts/%s", job.ArtifactsUrl(id), job.SafeName),
+	}
+}
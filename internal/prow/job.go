@@ -0,0 +1,328 @@
+// Package prow finds the builds of the Prow jobs, and reads the outcome of
+// their workflow steps from the published artifacts
+package prow
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andfasano/metal-ipi-releases/internal/gcs"
+)
+
+const (
+	// This is the url of the Prow page of a build
+	ViewUrl = "https://prow.ci.openshift.org/view/gs/origin-ci-test/logs"
+	// This is the url of the Prow page listing the builds of a job
+	JobHistoryUrl = "https://prow.ci.openshift.org/job-history/gs/origin-ci-test/logs"
+)
+
+// StepsLayout describes the workflow steps names and the artifacts
+// locations used by the metal-ipi jobs of a given release
+type StepsLayout struct {
+	// The workflow step installing the cluster
+	InstallStep string
+	// The workflow step running the e2e tests
+	TestStep string
+	// The workflow step releasing the baremetal hosts used by the build
+	TeardownStep string
+	// Where the junit files are stored, relative to the test step folder
+	JunitDir string
+	// The installer log, relative to the install step folder
+	InstallLog string
+	// Where the gather-extra step stores the pods logs, relative to the
+	// test artifacts folder
+	PodLogsDir string
+}
+
+var (
+	// Layout used by the current releases
+	defaultLayout = StepsLayout{
+		InstallStep:  "baremetalds-devscripts-setup",
+		TestStep:     "baremetalds-e2e-test",
+		TeardownStep: "baremetalds-packet-teardown",
+		JunitDir:     "artifacts/junit",
+		InstallLog:   "artifacts/.openshift_install.log",
+		PodLogsDir:   "gather-extra/artifacts/pods",
+	}
+
+	// Per-version layouts, for the releases not using the default one
+	versionLayouts = map[string]StepsLayout{
+		"4.6": {
+			InstallStep:  "baremetalds-devscripts-setup",
+			TestStep:     "baremetalds-e2e-test",
+			TeardownStep: "baremetalds-packet-teardown",
+			JunitDir:     "artifacts",
+			InstallLog:   "artifacts/.openshift_install.log",
+			PodLogsDir:   "gather-extra/artifacts/pods",
+		},
+		"4.7": {
+			InstallStep:  "baremetalds-devscripts-setup",
+			TestStep:     "baremetalds-e2e-test",
+			TeardownStep: "baremetalds-packet-teardown",
+			JunitDir:     "artifacts",
+			InstallLog:   "artifacts/.openshift_install.log",
+			PodLogsDir:   "gather-extra/artifacts/pods",
+		},
+		"4.8":  defaultLayout,
+		"4.9":  defaultLayout,
+		"4.10": defaultLayout,
+	}
+)
+
+// LayoutFor returns the steps layout for the specified version
+func LayoutFor(version string) StepsLayout {
+	if l, ok := versionLayouts[version]; ok {
+		return l
+	}
+	return defaultLayout
+}
+
+// JobLayout overrides the steps layout of the jobs matching a pattern
+type JobLayout struct {
+	pattern  *regexp.Regexp
+	testStep string
+	junitDir string
+}
+
+// ParseJobLayouts reads the layout overrides, given as
+// <job regex>=<test step>[:<junit dir>]
+func ParseJobLayouts(values []string) ([]JobLayout, error) {
+	layouts := []JobLayout{}
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid job layout %s, expected <job regex>=<test step>[:<junit dir>]", v)
+		}
+		re, err := regexp.Compile(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid job layout %s: %w", v, err)
+		}
+
+		l := JobLayout{pattern: re, testStep: parts[1]}
+		if i := strings.Index(parts[1], ":"); i >= 0 {
+			l.testStep, l.junitDir = parts[1][:i], parts[1][i+1:]
+		}
+		layouts = append(layouts, l)
+	}
+	return layouts, nil
+}
+
+// testName returns the ci-operator test name of a job, that is the name of
+// its artifacts folder, i.e. whatever follows the version in the job name
+func testName(name string) string {
+	if m := regexp.MustCompile(`-\d+\.\d+-(.+)$`).FindStringSubmatch(name); m != nil {
+		return m[1]
+	}
+	if i := strings.Index(name, "e2e"); i >= 0 {
+		return name[i:]
+	}
+	return name
+}
+
+// Job represent a Prow job, and where its builds artifacts are stored
+type Job struct {
+	Name string
+	// The ci-operator test name, i.e. the job artifacts folder
+	SafeName string
+	Version  string
+	Layout   StepsLayout
+	// Set for the pull requests jobs, whose builds are stored by pull request
+	Presubmit bool
+	// Set when the test step was configured, rather than detected
+	Overridden bool
+	// Where the builds of the pull requests jobs are stored within the
+	// artifacts bucket, by build id
+	BuildPaths map[string]string
+	// Downloads the builds artifacts
+	Client *gcs.Client
+}
+
+// NewJob returns the job with the given name, applying the first of the
+// layout overrides matching it
+func NewJob(name string, layouts []JobLayout, client *gcs.Client) *Job {
+	version := ""
+	if m := regexp.MustCompile(`-(\d+\.\d+)-`).FindStringSubmatch(name); m != nil {
+		version = m[1]
+	}
+
+	layout := LayoutFor(version)
+	overridden := false
+	for _, l := range layouts {
+		if l.pattern.MatchString(name) {
+			layout.TestStep = l.testStep
+			if l.junitDir != "" {
+				layout.JunitDir = l.junitDir
+			}
+			overridden = true
+			break
+		}
+	}
+
+	return &Job{
+		Name:       name,
+		SafeName:   testName(name),
+		Version:    version,
+		Layout:     layout,
+		Overridden: overridden,
+		Presubmit:  strings.HasPrefix(name, "pull-"),
+		BuildPaths: make(map[string]string),
+		Client:     client,
+	}
+}
+
+// IsUpgrade tells if the job upgrades the cluster before running the tests
+func (j *Job) IsUpgrade() bool {
+	return strings.Contains(j.SafeName, "upgrade")
+}
+
+// BuildsUrl returns the url of the folder listing the job builds
+func (j *Job) BuildsUrl() string {
+	if j.Presubmit {
+		return gcs.BucketUrl(gcs.BaseUrl, fmt.Sprintf("pr-logs/directory/%s/", j.Name))
+	}
+	return fmt.Sprintf("%s/%s/", gcs.BaseUrl, j.Name)
+}
+
+// BuildUrl returns the link to the Prow page of the given build
+func (j *Job) BuildUrl(id string) string {
+	if p, ok := j.BuildPaths[id]; ok {
+		return gcs.BucketUrl(ViewUrl, p)
+	}
+	return fmt.Sprintf("%s/%s/%s", ViewUrl, j.Name, id)
+}
+
+// ArtifactsUrl returns the link to the artifacts of the given build
+func (j *Job) ArtifactsUrl(id string) string {
+	if p, ok := j.BuildPaths[id]; ok {
+		return gcs.BucketUrl(gcs.BaseUrl, p)
+	}
+	return fmt.Sprintf("%s/%s/%s", gcs.BaseUrl, j.Name, id)
+}
+
+// HistoryUrl returns the url of the Prow page listing the job builds
+func (j *Job) HistoryUrl() string {
+	if j.Presubmit {
+		return gcs.BucketUrl(JobHistoryUrl, "pr-logs/directory/"+j.Name)
+	}
+	return fmt.Sprintf("%s/%s", JobHistoryUrl, j.Name)
+}
+
+var (
+	gcsPathRe  = regexp.MustCompile(`^gs://[^/]+/(\S+)`)
+	pullPathRe = regexp.MustCompile(`^pr-logs/pull/[^/]+/(\d+)/`)
+)
+
+// ResolveBuildPaths finds where the given builds of a pull requests job
+// are stored, reading the text files listing them. Builds whose pull
+// request is not within the given range are left unresolved
+func (j *Job) ResolveBuildPaths(ctx context.Context, ids []string, from int, to int) {
+	if !j.Presubmit {
+		return
+	}
+
+	paths := make([]string, len(ids))
+	j.Client.ForEachParallel(len(ids), func(i int) {
+		if _, ok := j.BuildPaths[ids[i]]; ok {
+			return
+		}
+		url := gcs.BucketUrl(gcs.BaseUrl, fmt.Sprintf("pr-logs/directory/%s/%s.txt", j.Name, ids[i]))
+		body, err := j.Client.Fetch(ctx, url)
+		if err != nil {
+			slog.Warn("Unable to find the build", "job", j.Name, "build", ids[i], "err", err)
+			return
+		}
+		m := gcsPathRe.FindStringSubmatch(strings.TrimSpace(string(body)))
+		if m == nil {
+			slog.Warn("Unable to find the build, unexpected location", "job", j.Name, "build", ids[i], "location", body)
+			return
+		}
+		paths[i] = m[1]
+	})
+
+	for i, p := range paths {
+		if p == "" {
+			continue
+		}
+		if from > 0 || to > 0 {
+			m := pullPathRe.FindStringSubmatch(p)
+			if m == nil {
+				continue
+			}
+			pr, _ := strconv.Atoi(m[1])
+			if pr < from || to > 0 && pr > to {
+				continue
+			}
+		}
+		j.BuildPaths[ids[i]] = p
+	}
+}
+
+// DetectLayout looks at the artifacts of the given build to find the test
+// folder and, unless configured, the step running the e2e tests, for the
+// job variants not following the usual naming
+func (j *Job) DetectLayout(ctx context.Context, id string) error {
+	tests, _, err := j.Client.ListFolder(ctx, fmt.Sprintf("%s/artifacts/", j.ArtifactsUrl(id)))
+	if err != nil {
+		return err
+	}
+
+	// The test folder is the longest one the job name ends with
+	found := false
+	for _, t := range tests {
+		if t == j.SafeName {
+			found = true
+			break
+		}
+	}
+	if !found {
+		best := ""
+		for _, t := range tests {
+			if strings.HasSuffix(j.Name, "-"+t) && len(t) > len(best) {
+				best = t
+			}
+		}
+		if best == "" {
+			return fmt.Errorf("test folder %s not found", j.SafeName)
+		}
+		slog.Debug("Using test folder", "job", j.Name, "folder", best)
+		j.SafeName = best
+	}
+
+	if j.Overridden {
+		return nil
+	}
+
+	steps, _, err := j.Client.ListFolder(ctx, fmt.Sprintf("%s/artifacts/%s/", j.ArtifactsUrl(id), j.SafeName))
+	if err != nil {
+		return err
+	}
+	candidates := []string{}
+	for _, step := range steps {
+		if step == j.Layout.TestStep {
+			return nil
+		}
+		if strings.Contains(step, "e2e") {
+			candidates = append(candidates, step)
+		}
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("test step %s not found", j.Layout.TestStep)
+	}
+
+	// Steps running the tests are preferred over the ones setting them up
+	sort.Slice(candidates, func(a, b int) bool {
+		ta, tb := strings.Contains(candidates[a], "test"), strings.Contains(candidates[b], "test")
+		if ta != tb {
+			return ta
+		}
+		return candidates[a] < candidates[b]
+	})
+	slog.Debug("Using test step", "job", j.Name, "step", candidates[0])
+	j.Layout.TestStep = candidates[0]
+	return nil
+}
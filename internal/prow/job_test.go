@@ -0,0 +1,67 @@
+package prow
+
+import (
+	"testing"
+)
+
+func TestNewJob(t *testing.T) {
+	layouts, err := ParseJobLayouts([]string{"-ovn-.*=baremetalds-e2e-ovn-test:artifacts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		safeName   string
+		version    string
+		testStep   string
+		junitDir   string
+		presubmit  bool
+		overridden bool
+	}{
+		{
+			name:     "periodic-ci-openshift-release-master-nightly-4.10-e2e-metal-ipi",
+			safeName: "e2e-metal-ipi",
+			version:  "4.10",
+			testStep: "baremetalds-e2e-test",
+			junitDir: "artifacts/junit",
+		},
+		{
+			name:     "periodic-ci-openshift-release-master-nightly-4.7-e2e-metal-ipi",
+			safeName: "e2e-metal-ipi",
+			version:  "4.7",
+			testStep: "baremetalds-e2e-test",
+			junitDir: "artifacts",
+		},
+		{
+			name:       "periodic-ci-openshift-release-master-nightly-4.10-e2e-metal-ipi-ovn-ipv6",
+			safeName:   "e2e-metal-ipi-ovn-ipv6",
+			version:    "4.10",
+			testStep:   "baremetalds-e2e-ovn-test",
+			junitDir:   "artifacts",
+			overridden: true,
+		},
+		{
+			name:      "pull-ci-openshift-installer-master-e2e-metal-ipi",
+			safeName:  "e2e-metal-ipi",
+			testStep:  "baremetalds-e2e-test",
+			junitDir:  "artifacts/junit",
+			presubmit: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := NewJob(tt.name, layouts, nil)
+			if j.SafeName != tt.safeName || j.Version != tt.version {
+				t.Errorf("expected test %s and version %s, got %s and %s", tt.safeName, tt.version, j.SafeName, j.Version)
+			}
+			if j.Layout.TestStep != tt.testStep || j.Layout.JunitDir != tt.junitDir {
+				t.Errorf("expected the %s step and the %s junit dir, got %s and %s", tt.testStep, tt.junitDir, j.Layout.TestStep, j.Layout.JunitDir)
+			}
+			if j.Presubmit != tt.presubmit || j.Overridden != tt.overridden {
+				t.Errorf("expected presubmit %t and overridden %t, got %t and %t", tt.presubmit, tt.overridden, j.Presubmit, j.Overridden)
+			}
+		})
+	}
+}
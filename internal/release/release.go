@@ -0,0 +1,259 @@
+// Package release describes the OpenShift release streams, and looks up
+// their payloads and the tests pass rates across all their jobs
+package release
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andfasano/metal-ipi-releases/internal/gcs"
+)
+
+// Stream describes how the metal-ipi jobs verifying the payloads
+// of a release stream are named, i.e. <Prefix><version>-<test><Suffix>
+type Stream struct {
+	Prefix string
+	Suffix string
+	// The prefix of the OKD jobs matching the stream ones, if any
+	OkdPrefix string
+	// The release controller architecture, and the payloads stream name
+	// where %s is replaced by the version
+	Arch    string
+	Release string
+}
+
+// Supported release streams. The stable and 4-stable streams are missing
+// on purpose: their payloads are promoted across all the 4.y versions,
+// with no periodic metal-ipi jobs of their own to analyze
+var Streams = map[string]Stream{
+	"nightly": {Prefix: "periodic-ci-openshift-release-master-nightly-", OkdPrefix: "periodic-ci-openshift-release-master-okd-", Arch: "amd64", Release: "%s.0-0.nightly"},
+	"ci":      {Prefix: "periodic-ci-openshift-release-master-ci-", Arch: "amd64", Release: "%s.0-0.ci"},
+	"arm64":   {Prefix: "periodic-ci-openshift-release-master-nightly-", Suffix: "-arm64", Arch: "arm64", Release: "%s.0-0.nightly-arm64"},
+	"multi":   {Prefix: "periodic-ci-openshift-release-master-nightly-", Suffix: "-multi", Arch: "multi", Release: "%s.0-0.nightly-multi"},
+	"ppc64le": {Prefix: "periodic-ci-openshift-release-master-nightly-", Suffix: "-ppc64le", Arch: "ppc64le", Release: "%s.0-0.nightly-ppc64le"},
+}
+
+// StreamNames returns the supported release streams, sorted
+func StreamNames() []string {
+	names := []string{}
+	for name := range Streams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// JobName returns the name of the job running the given test
+// on a version of the release stream
+func (rs Stream) JobName(version string, test string) string {
+	return fmt.Sprintf("%s%s-%s%s", rs.Prefix, version, test, rs.Suffix)
+}
+
+// SplitJobName returns the version and the test of a job of the
+// release stream, or false for the jobs of other streams
+func (rs Stream) SplitJobName(name string) (string, string, bool) {
+	re := regexp.MustCompile(fmt.Sprintf(`^%s(\d+\.\d+)-(.+)%s$`, regexp.QuoteMeta(rs.Prefix), regexp.QuoteMeta(rs.Suffix)))
+	m := re.FindStringSubmatch(name)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// JobVariants returns the techpreview and OKD variants names of the job
+// running the given test on a version of the release stream. The OKD
+// ones exist only for the streams with a matching OKD stream
+func (rs Stream) JobVariants(version string, test string) []string {
+	variants := []string{rs.JobName(version, test+"-techpreview")}
+	if rs.OkdPrefix != "" {
+		variants = append(variants, fmt.Sprintf("%s%s-%s", rs.OkdPrefix, version, test))
+	}
+	return variants
+}
+
+// sippyTest is a test pass rate returned by the Sippy API, for all the
+// jobs of a release or only for the ones of some variants
+type sippyTest struct {
+	Name           string   `json:"name"`
+	Variants       []string `json:"variants"`
+	PassPercentage float64  `json:"current_pass_percentage"`
+	Runs           int      `json:"current_runs"`
+}
+
+// SippyVariant is the pass rate of a test in the jobs of some variants
+type SippyVariant struct {
+	Variants string  `json:"variants"`
+	PassRate float64 `json:"passRate"`
+	Runs     int     `json:"runs"`
+}
+
+// SippySummary is the pass rate of a test in all the jobs of a release,
+// according to Sippy, with the breakdown by variant
+type SippySummary struct {
+	PassRate float64 `json:"passRate"`
+	Runs     int     `json:"runs"`
+	// From the variants where the test passes less often
+	Variants []SippyVariant `json:"variants"`
+}
+
+// Sippy looks up the pass rates of the tests in all the jobs of a release
+type Sippy struct {
+	Url    string
+	Client *gcs.Client
+}
+
+// Summary queries Sippy for the pass rates of a test in the given
+// release, by variant. The overall pass rate is weighted by the runs
+func (s *Sippy) Summary(ctx context.Context, release string, test string) (*SippySummary, error) {
+	filter, err := json.Marshal(map[string]interface{}{
+		"items": []map[string]string{
+			{"columnField": "name", "operatorValue": "equals", "value": test},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("release", release)
+	query.Set("filter", string(filter))
+	query.Set("collapse", "false")
+
+	body, err := s.Client.Fetch(ctx, fmt.Sprintf("%s/api/tests?%s", s.Url, query.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	tests := []sippyTest{}
+	if err := json.Unmarshal(body, &tests); err != nil {
+		return nil, err
+	}
+	if len(tests) == 0 {
+		return nil, nil
+	}
+
+	summary := &SippySummary{}
+	passed := 0.0
+	for _, t := range tests {
+		summary.Runs += t.Runs
+		passed += t.PassPercentage / 100 * float64(t.Runs)
+		summary.Variants = append(summary.Variants, SippyVariant{
+			Variants: strings.Join(t.Variants, ","),
+			PassRate: t.PassPercentage / 100,
+			Runs:     t.Runs,
+		})
+	}
+	if summary.Runs > 0 {
+		summary.PassRate = passed / float64(summary.Runs)
+	}
+	sort.Slice(summary.Variants, func(i, j int) bool {
+		return summary.Variants[i].PassRate < summary.Variants[j].PassRate
+	})
+
+	return summary, nil
+}
+
+// Show prints the Sippy pass rates below a flaky test
+func (s *SippySummary) Show() {
+	const maxVariants = 3
+	worst := []string{}
+	for i, v := range s.Variants {
+		if i == maxVariants {
+			break
+		}
+		worst = append(worst, fmt.Sprintf("%s %.0f%% (%d runs)", v.Variants, v.PassRate*100, v.Runs))
+	}
+	fmt.Printf("%64ssippy: %.0f%% over %d runs, worst variants: %s\n", "", s.PassRate*100, s.Runs, strings.Join(worst, "; "))
+}
+
+// Payload is a payload returned by the release controller API
+type Payload struct {
+	Name  string `json:"name"`
+	Phase string `json:"phase"`
+}
+
+// releaseTags lists the payloads of a release stream, newest first
+type releaseTags struct {
+	Tags []Payload `json:"tags"`
+}
+
+// ReleaseController looks up the payloads of the release streams
+type ReleaseController struct {
+	// The release controller API, where %s is replaced by the stream architecture
+	Url    string
+	Client *gcs.Client
+}
+
+// NewestPayload returns the newest payload of the given release
+// stream, whatever its phase
+func (rc *ReleaseController) NewestPayload(ctx context.Context, rs Stream, version string) (Payload, error) {
+	name := fmt.Sprintf(rs.Release, version)
+	url := fmt.Sprintf(rc.Url, rs.Arch) + fmt.Sprintf("/api/v1/releasestream/%s/tags", name)
+	body, err := rc.Client.Fetch(ctx, url)
+	if err != nil {
+		return Payload{}, err
+	}
+
+	tags := releaseTags{}
+	if err := json.Unmarshal(body, &tags); err != nil {
+		return Payload{}, err
+	}
+	if len(tags.Tags) == 0 {
+		return Payload{}, fmt.Errorf("no payloads found for %s", name)
+	}
+	return tags.Tags[0], nil
+}
+
+var payloadDateRe = regexp.MustCompile(`(\d{4}-\d{2}-\d{2}-\d{6})$`)
+
+// LastAccepted returns the newest accepted payload of the given
+// release stream, and when it was built, according to its name
+func (rc *ReleaseController) LastAccepted(ctx context.Context, rs Stream, version string) (string, time.Time, error) {
+	name := fmt.Sprintf(rs.Release, version)
+	url := fmt.Sprintf(rc.Url, rs.Arch) + fmt.Sprintf("/api/v1/releasestream/%s/latest", name)
+	body, err := rc.Client.Fetch(ctx, url)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	payload := Payload{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", time.Time{}, err
+	}
+	m := payloadDateRe.FindStringSubmatch(payload.Name)
+	if m == nil {
+		return payload.Name, time.Time{}, fmt.Errorf("no date found in the payload name %s", payload.Name)
+	}
+	built, err := time.Parse("2006-01-02-150405", m[1])
+	return payload.Name, built, err
+}
+
+// PayloadStatus is the newest accepted payload of a version
+type PayloadStatus struct {
+	Version string    `json:"version"`
+	Payload string    `json:"payload,omitempty"`
+	Built   time.Time `json:"built,omitempty"`
+	Age     string    `json:"age,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// PayloadsStatus returns the newest accepted payload of every version
+func (rc *ReleaseController) PayloadsStatus(ctx context.Context, rs Stream, versions []string) []PayloadStatus {
+	payloads := []PayloadStatus{}
+	for _, v := range versions {
+		ps := PayloadStatus{Version: v}
+		name, built, err := rc.LastAccepted(ctx, rs, v)
+		if err != nil {
+			ps.Error = err.Error()
+		} else {
+			ps.Payload, ps.Built = name, built
+			ps.Age = time.Since(built).Round(time.Minute).String()
+		}
+		payloads = append(payloads, ps)
+	}
+	return payloads
+}
@@ -0,0 +1,96 @@
+package release
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJobVariants(t *testing.T) {
+	tests := []struct {
+		stream   string
+		version  string
+		test     string
+		expected []string
+	}{
+		{
+			stream:  "nightly",
+			version: "4.10",
+			test:    "e2e-metal-ipi",
+			expected: []string{
+				"periodic-ci-openshift-release-master-nightly-4.10-e2e-metal-ipi-techpreview",
+				"periodic-ci-openshift-release-master-okd-4.10-e2e-metal-ipi",
+			},
+		},
+		{
+			stream:  "ci",
+			version: "4.9",
+			test:    "e2e-metal-ipi-upgrade",
+			expected: []string{
+				"periodic-ci-openshift-release-master-ci-4.9-e2e-metal-ipi-upgrade-techpreview",
+			},
+		},
+		{
+			stream:  "arm64",
+			version: "4.10",
+			test:    "e2e-metal-ipi",
+			expected: []string{
+				"periodic-ci-openshift-release-master-nightly-4.10-e2e-metal-ipi-techpreview-arm64",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.stream, func(t *testing.T) {
+			got := Streams[tt.stream].JobVariants(tt.version, tt.test)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestSplitJobName(t *testing.T) {
+	tests := []struct {
+		name    string
+		job     string
+		version string
+		test    string
+		ok      bool
+	}{
+		{
+			name:    "nightly job",
+			job:     "periodic-ci-openshift-release-master-nightly-4.10-e2e-metal-ipi",
+			version: "4.10",
+			test:    "e2e-metal-ipi",
+			ok:      true,
+		},
+		{
+			name:    "nightly variant",
+			job:     "periodic-ci-openshift-release-master-nightly-4.10-e2e-metal-ipi-ovn-ipv6",
+			version: "4.10",
+			test:    "e2e-metal-ipi-ovn-ipv6",
+			ok:      true,
+		},
+		{
+			name: "other stream",
+			job:  "periodic-ci-openshift-release-master-ci-4.10-e2e-metal-ipi",
+		},
+		{
+			name: "presubmit",
+			job:  "pull-ci-openshift-installer-master-e2e-metal-ipi",
+		},
+	}
+
+	rs := Streams["nightly"]
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, test, ok := rs.SplitJobName(tt.job)
+			if version != tt.version || test != tt.test || ok != tt.ok {
+				t.Errorf("expected (%q, %q, %t), got (%q, %q, %t)", tt.version, tt.test, tt.ok, version, test, ok)
+			}
+			if ok && rs.JobName(version, test) != tt.job {
+				t.Errorf("expected %s to be rebuilt, got %s", tt.job, rs.JobName(version, test))
+			}
+		})
+	}
+}
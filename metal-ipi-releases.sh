@@ -4,47 +4,329 @@ function showHelp() {
     echo "This script gets the latest release build failures for metal-ipi jobs"
     echo "(only if there isn't any newer passing build for that job)"
     echo 
-    echo "Usage: metal-ipi-releases [-h|-c] <ver>"
+    echo "Usage: metal-ipi-releases [--cache-dir <dir>] [--stream <stream>] [--min-version <ver>] [--max-version <ver>] [--release-repo <org>/<repo>[@<branch>]] [--no-ui|--json] [--export <file>] [-h|-c|--offline|clean|payloads|changelog] <ver>"
     echo "Options:"
+    echo "--cache-dir Where the cached data are stored (default: \$XDG_CACHE_HOME/metal-ipi-releases)"
+    echo "--stream    Release stream to track: nightly, ci, arm64, multi or ppc64le (default: nightly)"
+    echo "--min-version, --max-version  Track only the releases in the given range, e.g. 4.8 (optional)"
+    echo "--release-repo  Repo and branch of the release configs, e.g. myfork/release@release-4.10 (default: openshift/release@master)"
+    echo "--no-ui     Print plain text, without colors and with the links as urls, e.g. when not on a terminal"
+    echo "--json      Print the releases summary, the failed and the running jobs as JSON"
+    echo "--export    Also write the failed jobs table to the given .md (Markdown) or .csv file"
     echo "-h    Show this help"
-    echo "-c    Use the locally cached results, skip downloading Prow results"
+    echo "-c, --offline  Use only the locally cached results, without any network access"
+    echo "clean Remove all the cached data"
+    echo "payloads <ver>  Show the latest payloads of the stream with their metal-ipi verification results"
+    echo "changelog <ver> Show the pull requests merged between the last accepted payload and the newest rejected one"
     echo "<ver> Filter by version, e.g. 4.9 (optional)"
+    echo
+    echo "Environment:"
+    echo "RELEASE_ORG        GitHub org of the release configs repo (default: openshift)"
+    echo "RELEASE_REPO       GitHub repo of the release configs (default: release)"
+    echo "RELEASE_BRANCH     Branch of the release configs repo (default: master)"
+    echo "RELEASE_LOCAL_DIR  Local folder with additional release-ocp-*.json files (optional)"
+    echo "GITHUB_API_URL     GitHub API endpoint, for mirrors hosted on GitHub Enterprise (default: https://api.github.com)"
+    echo "GITHUB_RAW_URL     Where the raw repo files are served from (default: https://raw.githubusercontent.com)"
+    echo "FETCH_RETRIES      Retries for transient download failures, with exponential backoff (default: 3)"
+    echo "CA_BUNDLE          PEM file with additional CA certificates to trust (optional)"
+    echo "AUTH_TOKEN         Bearer token for private Prow and GCS endpoints (optional)"
+    echo "RATE_LIMIT         Maximum number of requests per second, 0 for no limit (default: 10)"
+    echo "CONCURRENCY        Maximum number of parallel downloads (default: 8)"
+    echo "HTTPS_PROXY, NO_PROXY are honored for all the downloads"
+    echo "STALE_PAYLOAD_HOURS  Hours after which the last accepted payload is highlighted as stale (default: 48)"
+    echo "RELEASE_CONTROLLER_URL  Release-controller API endpoint (default: the one of the selected stream architecture)"
+    echo "DECK_URL           Prow Deck endpoint, where the jobs are listed from (default: https://prow.ci.openshift.org)"
     exit 1 
 }
 
+CACHE_DIR=${XDG_CACHE_HOME:-$HOME/.cache}/metal-ipi-releases
+STREAM=nightly
+OUTPUT=ui
+while true; do
+  case "$1" in
+    --cache-dir) CACHE_DIR=$2; shift 2 ;;
+    --stream) STREAM=$2; shift 2 ;;
+    --min-version) MIN_VERSION=$2; shift 2 ;;
+    --max-version) MAX_VERSION=$2; shift 2 ;;
+    --release-repo) RELEASE_SOURCE=$2; shift 2 ;;
+    --no-ui) OUTPUT=text; shift ;;
+    --json) OUTPUT=json; shift ;;
+    --export) EXPORT_FILE=$2; shift 2 ;;
+    *) break ;;
+  esac
+done
+
+# For every release stream: the suffix of its release configs, the architecture
+# of its release-controller, and the name of its streams given the version.
+# The stable and 4-stable streams are not supported: they have no per-version
+# release configs, and no metal-ipi verification jobs of their own
+case $STREAM in
+  nightly) STREAM_CONFIG_SUFFIX="";         STREAM_ARCH=amd64;   STREAM_NAME_FMT="%s.0-0.nightly" ;;
+  ci)      STREAM_CONFIG_SUFFIX="-ci";      STREAM_ARCH=amd64;   STREAM_NAME_FMT="%s.0-0.ci" ;;
+  arm64)   STREAM_CONFIG_SUFFIX="-arm64";   STREAM_ARCH=arm64;   STREAM_NAME_FMT="%s.0-0.nightly-arm64" ;;
+  multi)   STREAM_CONFIG_SUFFIX="-multi";   STREAM_ARCH=multi;   STREAM_NAME_FMT="%s.0-0.nightly-multi" ;;
+  ppc64le) STREAM_CONFIG_SUFFIX="-ppc64le"; STREAM_ARCH=ppc64le; STREAM_NAME_FMT="%s.0-0.nightly-ppc64le" ;;
+  *)
+    echo "Unsupported release stream $STREAM"
+    showHelp
+    ;;
+esac
+
+case $EXPORT_FILE in
+  ""|*.md|*.csv) ;;
+  *)
+    echo "Unsupported export format $EXPORT_FILE, expected a .md or .csv file"
+    showHelp
+    ;;
+esac
+
 if [ "$1" = "-h" ]; then
   showHelp
   exit 1
 fi
 
-CACHE_FOLDER=.releases
+if [ "$1" = "clean" ]; then
+  echo "Removing $CACHE_DIR"
+  rm -rf "$CACHE_DIR"
+  exit 0
+fi
+
+CACHE_FOLDER=$CACHE_DIR/releases/$STREAM
+PROW_JOBS=$CACHE_DIR/prow-jobs.json
 mkdir -p $CACHE_FOLDER
 
-function fetchReleasesConfig() {
-    MAJOR_VERSION=4
-    BASE_MINOR_VERSION=6
-    releases_url="https://raw.githubusercontent.com/openshift/release/master/core-services/release-controller/_releases/"
+# The --release-repo option takes precedence over the environment
+if [ -n "$RELEASE_SOURCE" ]; then
+    RELEASE_ORG=${RELEASE_SOURCE%%/*}
+    RELEASE_REPO=${RELEASE_SOURCE#*/}
+    RELEASE_REPO=${RELEASE_REPO%@*}
+    if [[ $RELEASE_SOURCE == *@* ]]; then
+        RELEASE_BRANCH=${RELEASE_SOURCE#*@}
+    fi
+fi
+RELEASE_ORG=${RELEASE_ORG:-openshift}
+RELEASE_REPO=${RELEASE_REPO:-release}
+RELEASE_BRANCH=${RELEASE_BRANCH:-master}
+GITHUB_API_URL=${GITHUB_API_URL:-https://api.github.com}
+GITHUB_RAW_URL=${GITHUB_RAW_URL:-https://raw.githubusercontent.com}
+STALE_PAYLOAD_HOURS=${STALE_PAYLOAD_HOURS:-48}
+FETCH_RETRIES=${FETCH_RETRIES:-3}
+RELEASE_CONTROLLER_URL=${RELEASE_CONTROLLER_URL:-https://$STREAM_ARCH.ocp.releases.ci.openshift.org}
+RATE_LIMIT=${RATE_LIMIT:-10}
+DECK_URL=${DECK_URL:-https://prow.ci.openshift.org}
+CONCURRENCY=${CONCURRENCY:-8}
+
+# Options shared by all the downloads
+curlOpts=(--retry $FETCH_RETRIES)
+if [ -n "$CA_BUNDLE" ]; then
+    curlOpts+=(--cacert "$CA_BUNDLE")
+fi
+
+# The token is sent only to the Prow endpoints, never to GitHub
+prowOpts=()
+if [ -n "$AUTH_TOKEN" ]; then
+    prowOpts+=(-H "Authorization: Bearer $AUTH_TOKEN")
+fi
+
+# Spaces out the requests so that no more than RATE_LIMIT are sent every second.
+# The time of the last request is kept on file, since it's updated also from subshells,
+# and locked, so that the parallel downloads wait for their turn
+function throttle() {
+    if [ "$RATE_LIMIT" = "0" ]; then
+        return
+    fi
+
+    (
+        flock 9
+        now=$(date +%s%N)
+        last=$(cat $CACHE_DIR/.last-request 2>/dev/null || echo 0)
+        delay=$(awk -v now=$now -v last=$last -v rate=$RATE_LIMIT 'BEGIN { d = (last + 1e9 / rate - now) / 1e9; if (d > 0) printf "%.3f", d }')
+        if [ -n "$delay" ]; then
+            sleep $delay
+        fi
+        date +%s%N > $CACHE_DIR/.last-request
+    ) 9> $CACHE_DIR/.last-request.lock
+}
+
+# Downloads are always rate limited and share the same options
+function fetch() {
+    throttle
+    curl "${curlOpts[@]}" "$@"
+}
+
+# Prints a link to the given url, shown as the given text on the terminal UI,
+# and as the url itself otherwise. It's meant to be printed with %b
+function hyperlink() {
+    if [ "$OUTPUT" = "ui" ]; then
+        echo "\e]8;;$1\a$2\e]8;;\a"
+    else
+        echo "$1"
+    fi
+}
+
+#-----------------------------------------------------------------------------
+# Deck API client
+
+# Lists the Prow jobs whose name matches the given pattern, with their
+# latest builds, as [{type, job, state, started, url, build_id}]. Deck
+# serves all the jobs at once, without any pagination or server side
+# filtering, so the large unused fields are omitted from the reply
+function deckJobs() {
+    fetch -s --fail "${prowOpts[@]}" "$DECK_URL/prowjobs.js?omit=annotations,labels,decoration_config,pod_spec" | jq --arg nf "$1" '[ .items[] | select(.spec.job | test($nf)) | {type: .spec.type, job: .spec.job, state: .status.state, started: (.status.startTime | sub("\\.[0-9]+Z$"; "Z") | fromdateiso8601 | tostring), url: .status.url, build_id: .status.build_id} ]'
+}
+#-----------------------------------------------------------------------------
+# Release-controller API client
+
+# Queries the release-controller REST API, e.g. rcApi releasestream/4.10.0-0.nightly/tags
+function rcApi() {
+    fetch -s --fail "$RELEASE_CONTROLLER_URL/api/v1/$1"
+}
+
+# Lists the release streams with at least an accepted payload
+function rcStreams() {
+    rcApi "releasestreams/accepted" | jq -r 'keys[]'
+}
+
+# Prints the name of the release stream of the given version, e.g. 4.10.0-0.nightly
+function streamName() {
+    printf "$STREAM_NAME_FMT" $1
+}
+
+# Prints the last accepted payload of the given stream
+function rcLatestAccepted() {
+    rcApi "releasestream/$1/latest" | jq -r '.name // empty'
+}
+
+# Lists the payloads of the given stream, from the newest, as "<tag> <phase>"
+function rcTags() {
+    rcApi "releasestream/$1/tags" | jq -r '.tags[] | "\(.name) \(.phase)"'
+}
+
+# Lists the verification jobs of the given payload as "<type> <name> <state> <url>"
+function rcVerification() {
+    rcApi "releasestream/$1/release/$2" | jq -r '.results // {} | to_entries[] | .key as $type | .value | to_entries[] | "\($type | sub("Jobs$"; "")) \(.key) \(.value.state) \(.value.url)"'
+}
+
+# Lists the commits changed between two payloads, grouped by image, as
+# tab separated "<image> <repo> <pull id> <pull url> <subject>". Missing
+# values are printed as "-", since read would skip the empty ones
+function rcChangelog() {
+    fetch -s --fail "$RELEASE_CONTROLLER_URL/changelog?from=$1&to=$2&format=json" | jq -r '.updatedImages // [] | .[] | .name as $image | (.path // "-") as $repo | .commits // [] | .[] | [$image, $repo, (.pullID // "-" | tostring), (.pullURL // "-"), .subject] | @tsv'
+}
+#-----------------------------------------------------------------------------
+
+# Tells if the given version is within MIN_VERSION and MAX_VERSION
+function versionInRange() {
+    if [ -n "$MIN_VERSION" ] && [ "$(printf '%s\n' "$MIN_VERSION" "$1" | sort -V | head -n 1)" != "$MIN_VERSION" ]; then
+        return 1
+    fi
+    if [ -n "$MAX_VERSION" ] && [ "$(printf '%s\n' "$MAX_VERSION" "$1" | sort -V | head -n 1)" != "$1" ]; then
+        return 1
+    fi
+}
+
+# Downloads a release config into the cache, unless unchanged since
+# the last time, given the configs url, the ETags folder and the file
+function fetchReleaseConfig() {
+    url=$1$3
+    etags=$2
+    file=$3
+
+    conditional=()
+    if [ -f $CACHE_FOLDER/$file ] && [ -s $etags/$file ]; then
+        conditional=(-H "If-None-Match: $(cat $etags/$file)")
+    fi
+    if ! status=$(fetch "${conditional[@]}" -D $etags/$file.headers -o $etags/$file.part --silent --fail -w "%{http_code}" "$url"); then
+        echo "Unable to fetch $file" >&2
+        rm -f $etags/$file.headers $etags/$file.part
+        return
+    fi
+    if [ "$status" = "200" ]; then
+        mv $etags/$file.part $CACHE_FOLDER/$file
+        grep -i '^etag:' $etags/$file.headers | cut -d' ' -f2- | tr -d '\r' > $etags/$file
+    fi
+    rm -f $etags/$file.headers $etags/$file.part
+}
 
-    echo "Fetching release metal-ipi jobs configurations"
+# Downloads the release configs of the selected versions, keeping the
+# cached ones when the repo contents could not be listed
+function downloadReleasesConfig() {
+    releases_path="core-services/release-controller/_releases"
+    releases_url="$GITHUB_RAW_URL/$RELEASE_ORG/$RELEASE_REPO/$RELEASE_BRANCH/$releases_path/"
 
-    for (( i=$BASE_MINOR_VERSION; ;i++)); do
-        file="release-ocp-$MAJOR_VERSION.$i.json"
-        url=$releases_url$file
-        if ! curl -o .releases/$file --silent --fail "$url"; then
-            break
+    echo "Fetching release metal-ipi jobs configurations for the $STREAM stream from $RELEASE_ORG/$RELEASE_REPO@$RELEASE_BRANCH" >&2
+
+    # The available releases are discovered from the configs found in the repo
+    if ! listing=$(fetch -s --fail "$GITHUB_API_URL/repos/$RELEASE_ORG/$RELEASE_REPO/contents/$releases_path?ref=$RELEASE_BRANCH"); then
+        echo "Unable to list the release configurations, using the cached ones" >&2
+        return
+    fi
+    configs=$(echo "$listing" | jq -r '.[].name')
+
+    selected=()
+    for file in $configs; do
+        if [[ $file =~ ^release-ocp-([0-9]+\.[0-9]+)$STREAM_CONFIG_SUFFIX\.json$ ]] && versionInRange ${BASH_REMATCH[1]}; then
+            selected+=($file)
+        fi
+    done
+
+    # Configs no longer selected must not be reported
+    for config in $CACHE_FOLDER/release-ocp-*.json; do
+        if [ -f "$config" ] && ! printf '%s\n' "${selected[@]}" | grep -qx "$(basename $config)"; then
+            rm -f "$config"
         fi
     done
+
+    # ETags are kept to skip downloading unchanged configurations
+    etags=$CACHE_FOLDER/.etags
+    mkdir -p $etags
+
+    # Configs are downloaded in parallel, up to CONCURRENCY at once
+    for file in "${selected[@]}"; do
+        fetchReleaseConfig $releases_url $etags $file &
+        while [ $(jobs -rp | wc -l) -ge $CONCURRENCY ]; do
+            wait -n
+        done
+    done
+    wait
+}
+
+function fetchReleasesConfig() {
+    downloadReleasesConfig
+
+    # Local configs take precedence over the downloaded ones, and are
+    # used also when the download failed
+    if [ -n "$RELEASE_LOCAL_DIR" ]; then
+        echo "Using local release configurations from $RELEASE_LOCAL_DIR" >&2
+        for config in "$RELEASE_LOCAL_DIR"/release-ocp-*.json; do
+            if [[ $(basename $config) =~ ^release-ocp-([0-9]+\.[0-9]+)$STREAM_CONFIG_SUFFIX\.json$ ]] && versionInRange ${BASH_REMATCH[1]}; then
+                cp "$config" $CACHE_FOLDER/
+            fi
+        done
+    fi
 }
 
 function checkForRefresh() {
-    echo "metal-ipi-releases.sh starting on $(date) ($(date --utc))"
+    echo "metal-ipi-releases.sh starting on $(date) ($(date --utc))" >&2
     # Download the current Prow status
-    if [ "$1" = "-c" ]; then 
+    if [ "$1" = "-c" ] || [ "$1" = "--offline" ]; then 
         ver=$2
+        cached=1
+        if [ ! -f $PROW_JOBS ]; then
+            echo "No cached Prow results found in $CACHE_DIR, please run once without $1" >&2
+            exit 1
+        fi
     else
         ver=$1
-        echo "Fetching latest job results from Prow, please wait"
-        curl -s https://deck-ci.apps.ci.l2s4.p1.openshiftapps.com/\data.js > .prow-jobs.json
+        echo "Fetching latest job results from Prow, please wait" >&2
+        if jobs=$(deckJobs "metal-ipi") && [ -n "$jobs" ]; then
+            echo "$jobs" > $PROW_JOBS
+        elif [ -f $PROW_JOBS ]; then
+            echo "Unable to fetch the Prow jobs, using the cached ones" >&2
+        else
+            echo "Unable to fetch the Prow jobs" >&2
+            exit 1
+        fi
         fetchReleasesConfig
     fi
 }
@@ -54,24 +336,101 @@ function getJobNames() {
         metalBlocking=${metalBlocking}$(jq -r '.verify | with_entries(select((.key|test("metal-ipi")) and (.value.optional == null or .value.optional == false))) | .[] | .prowJob.name' $config)
         metalInforming=${metalInforming}$(jq -r '.verify | with_entries(select((.key|test("metal-ipi")) and (.value.optional == true) and (.value.upgrade == null or .value.upgrade == false))) | .[] | .prowJob.name' $config)
         metalUpgrades=${metalUpgrades}$(jq -r '.verify | with_entries(select((.key|test("metal-ipi")) and (.value.optional == true) and (.value.upgrade == true))) | .[] | .prowJob.name' $config)
+        metalAggregated=${metalAggregated}$(jq -r '.verify | with_entries(select((.key|test("metal-ipi")) and (.value.aggregatedProwJob != null))) | .[] | .prowJob.name' $config)
     done
 }
 
 function workflowStepFailed() {
-    stepJson=$(curl -s "$1/$2/finished.json")
+    # Steps results are never cached
+    if [ -n "$cached" ]; then
+        return 1
+    fi
+
+    stepJson=$(fetch -s "${prowOpts[@]}" "$1/$2/finished.json")
     [[ $(echo $stepJson | jq -e '.passed' 2>&1 ) == "false" ]];
 }
 
+# Shows the latest payloads of the given version, with the results
+# of their metal-ipi verification jobs
+function showPayloads() {
+    stream=$(streamName $1)
+    payloadsFmt="%-40s%-10s%-10s%-40s%-11s%b\n"
+
+    printf "$payloadsFmt" "PAYLOAD" "PHASE" "TYPE" "JOB" "STATE" "LINKS"
+    rcTags $stream | head -n 5 | while read tag phase; do
+        printf "$payloadsFmt" "$tag" "$phase" "" "" "" ""
+        rcVerification $stream $tag | grep metal-ipi | sort | while read type job state url; do
+            printf "$payloadsFmt" "" "" "$type" "$job" "$state" "$(hyperlink $url dashboard)"
+        done
+    done
+}
+
+# Shows the changes between the last accepted payload of the given version
+# and the newest rejected one, listing the repos and the pull requests changed
+function showChangelog() {
+    stream=$(streamName $1)
+    accepted=$(rcLatestAccepted $stream)
+    if [ -z "$accepted" ]; then
+        echo "No accepted payload found for $stream"
+        return
+    fi
+    # Tags are listed from the newest, so only the ones newer than the accepted payload are checked
+    rejected=$(rcTags $stream | awk -v accepted="$accepted" '$1 == accepted { exit } $2 == "Rejected" { print $1; exit }')
+    if [ -z "$rejected" ]; then
+        echo "No payload rejected after $accepted"
+        return
+    fi
+
+    echo "Changes from $accepted (accepted) to $rejected (rejected)"
+    changelogFmt="%-40s%-10b%s\n"
+    printf "$changelogFmt" "IMAGE" "PR" "TITLE"
+    last=""
+    rcChangelog $accepted $rejected | while IFS=$'\t' read image repo pull url subject; do
+        if [ "$image" != "$last" ]; then
+            printf "$changelogFmt" "$image" "" "$repo"
+            last=$image
+        fi
+        if [ "$pull" = "-" ]; then
+            pull=""
+        elif [ "$OUTPUT" = "ui" ]; then
+            pull="$(hyperlink $url "#$pull")$(printf '%*s' $((9 - ${#pull})) '')"
+        else
+            pull="#$pull"
+            subject="$subject $url"
+        fi
+        printf "$changelogFmt" "" "$pull" "$subject"
+    done
+}
+
+if [ "$1" = "payloads" ]; then
+    if [ -z "$2" ]; then
+        showHelp
+    fi
+    showPayloads $2
+    exit 0
+fi
+
+if [ "$1" = "changelog" ]; then
+    if [ -z "$2" ]; then
+        showHelp
+    fi
+    showChangelog $2
+    exit 0
+fi
+
 checkForRefresh $@
 getJobNames
 
 # Prefilter metal jobs by name/version
-filter="periodic-ci-openshift-release-master-nightly-$ver.*metal-ipi.*"
-allCurrentMetalPeriodics=$(jq --arg nf $filter -r '[ .[] | select(.job|test($nf)) | select((.type=="periodic") and (.state!="pending"))]' .prow-jobs.json)
+filter="periodic-.*-$ver.*metal-ipi.*"
+allCurrentMetalPeriodics=$(jq --arg nf $filter -r '[ .[] | select(.job|test($nf)) | select((.type=="periodic") and (.state!="pending"))]' $PROW_JOBS)
 
-fmt="%-6s%-11s%-50s%-23s%-32s%-11b  %-11b  %-11b\n"
+fmt="%-6s%-11s%-50s%-23s%-32s%s  %-11b  %-11b  %-11b\n"
 
-function showResultsFor () {
+# Lists the failed jobs among the given ones, that is the ones whose latest
+# build failed, as tab separated "<version> <type> <aggregated> <job> <build id>
+# <started> <failure reason> <last 10 builds> <build url> <artifacts url> <sippy url>"
+function collectResultsFor () {
 
     jobType=$2
 
@@ -95,10 +454,17 @@ function showResultsFor () {
             started=${jobsInfo[2]}
             url=${jobsInfo[3]}
             jobSafeName=$(echo $jobName | sed  's/.*\(e2e.*\)/\1/')
-            jobDisplayName=$(echo ${jobName} | sed -E 's/.[^[[:digit:]]*]*-[[:digit:]]\.[[:digit:]]+-(.*)/\1/')
+
+            aggregated=false
+            if echo "$metalAggregated" | grep -qx "$jobName"; then
+                aggregated=true
+            fi
             
             # Look for failure reason
             reason="Unkown failure, please triage"
+            if [ -n "$cached" ]; then
+                reason="Not available offline"
+            fi
             link=$url
             baseArtifactsUrl="https://gcsweb-ci.apps.ci.l2s4.p1.openshiftapps.com/gcs/origin-ci-test/logs/${jobName}/${buildId}/artifacts/${jobSafeName}"
 
@@ -112,17 +478,171 @@ function showResultsFor () {
                 link="$baseArtifactsUrl/baremetalds-devscripts-setup/artifacts/root/dev-scripts/logs/"
             fi
             
-            artifactsLink="\e]8;;$link\aartifacts\e]8;;\a"
-            dashboardLink="\e]8;;$url\adashboard\e]8;;\a"
-            sippyLink="\e]8;;https://sippy.ci.openshift.org/sippy-ng/jobs/$version/analysis?filters=%7B%22items%22%3A%5B%7B%22columnField%22%3A%22name%22%2C%22operatorValue%22%3A%22equals%22%2C%22value%22%3A%22$jobName%22%7D%5D%7D\asippy\e]8;;\a"              
-            printf "$fmt" "$version" "$jobType" "$jobDisplayName" "$started" "$reason" "$dashboardLink" "$artifactsLink" "$sippyLink"
+            # Results of the last builds, from the oldest to the newest
+            sparkline=$(echo $jobs | jq -s --arg job "$k" -r '[ .[][] | select(.job==$job)] | sort_by(.started) | .[-10:] | map(if .state=="success" then "✓" elif .state=="failure" then "✗" else "·" end) | join("")')
+
+            sippyUrl="https://sippy.ci.openshift.org/sippy-ng/jobs/$version/analysis?filters=%7B%22items%22%3A%5B%7B%22columnField%22%3A%22name%22%2C%22operatorValue%22%3A%22equals%22%2C%22value%22%3A%22$jobName%22%7D%5D%7D"
+            printf "%s\t" "$version" "$jobType" "$aggregated" "$jobName" "$buildId" "$started" "$reason" "$sparkline" "$url" "$link"
+            printf "%s\n" "$sippyUrl"
         fi
         
     done 
 }
 
-printf "$fmt" "VER" "TYPE" "JOB" "STARTED" "FAILURE REASON" "LINKS"
-showResultsFor "$metalInforming" "Informing"
-showResultsFor "$metalUpgrades" "Upgrade"
-showResultsFor "$metalBlocking" "Blocking"
+# Shows the failed jobs listed by collectResultsFor
+function showResults () {
+    echo -n "$1" | while IFS=$'\t' read version jobType aggregated jobName buildId started reason sparkline url link sippyUrl; do
+        jobDisplayName=$(echo ${jobName} | sed -E 's/.[^[[:digit:]]*]*-[[:digit:]]\.[[:digit:]]+-(.*)/\1/')
+        # Aggregated jobs are marked with a star
+        jobBadge=$jobType
+        if [ "$aggregated" = "true" ]; then
+            jobBadge="$jobType*"
+        fi
+        sparkline="$sparkline$(printf '%*s' $((10 - ${#sparkline})) '')"
+        printf "$fmt" "$version" "$jobBadge" "$jobDisplayName" "$started" "$reason" "$sparkline" "$(hyperlink $url dashboard)" "$(hyperlink $link artifacts)" "$(hyperlink $sippyUrl sippy)"
+    done
+}
+
+# Prints the failed jobs listed by collectResultsFor as a JSON array
+function resultsJson() {
+    echo -n "$1" | jq -R -s 'split("\n") | map(select(. != "") | split("\t") | {version: .[0], type: .[1], aggregated: (.[2] == "true"), job: .[3], build_id: .[4], started: .[5], reason: .[6], last_builds: .[7], links: {dashboard: .[8], artifacts: .[9], sippy: .[10]}})'
+}
+
+# For every version, counts how many jobs have their latest build passing
+function countGreenJobs() {
+    names=$(printf '%s\n' $1 | jq -R . | jq -s .)
+    echo $allCurrentMetalPeriodics | jq --argjson names "$names" -r '[ .[] | select(.job | IN($names[])) ] | group_by(.job) | map(max_by(.started)) | group_by(.job | capture("-(?<v>[0-9]+\\.[0-9]+)-").v) | .[] | "\(.[0].job | capture("-(?<v>[0-9]+\\.[0-9]+)-").v) \(map(select(.state=="success")) | length) \(length)"'
+}
+
+# Prints the last accepted payload of the stream for the given version,
+# followed by its age in hours, when known
+function lastAccepted() {
+    if [ -n "$cached" ]; then
+        return
+    fi
+
+    payload=$(rcLatestAccepted $(streamName $1))
+    # Payloads are named like 4.10.0-0.nightly-2021-10-14-123456
+    ts=$(echo $payload | sed -nE 's/.*-([0-9]{4}-[0-9]{2}-[0-9]{2})-([0-9]{2})([0-9]{2})([0-9]{2})$/\1 \2:\3:\4/p')
+    if [ -z "$ts" ]; then
+        echo "$payload"
+        return
+    fi
+    echo "$payload $(( ($(date --utc +%s) - $(date --utc -d "$ts" +%s)) / 3600 ))"
+}
+
+# Shows the last accepted payload of the stream for the given version,
+# highlighted when older than STALE_PAYLOAD_HOURS
+function lastAcceptedPayload() {
+    if [ -n "$cached" ]; then
+        return
+    fi
+
+    read payload age <<< "$(lastAccepted $1)"
+    if [ -z "$age" ]; then
+        echo "last accepted: unknown"
+        return
+    fi
+
+    if [ $age -le $STALE_PAYLOAD_HOURS ]; then
+        echo "last accepted: $payload (${age}h ago)"
+    elif [ "$OUTPUT" = "ui" ]; then
+        echo "\e[31mlast accepted: $payload (${age}h ago)\e[0m"
+    else
+        echo "last accepted: $payload (${age}h ago, stale)"
+    fi
+}
+
+function showSummary() {
+    declare -A badges
+    while read v green total; do
+        badges[$v]="${badges[$v]}blocking: $green/$total green  "
+    done < <(countGreenJobs "$metalBlocking")
+    while read v green total; do
+        badges[$v]="${badges[$v]}informing: $green/$total green  "
+    done < <(countGreenJobs "$metalInforming")
+    while read v green total; do
+        badges[$v]="${badges[$v]}upgrade: $green/$total green  "
+    done < <(countGreenJobs "$metalUpgrades")
+
+    for v in $(printf '%s\n' "${!badges[@]}" | sort -V); do
+        printf "%-6s%s%b\n" "$v" "${badges[$v]}" "$(lastAcceptedPayload $v)"
+    done
+    echo
+}
+
+# Prints the summary of every version as a JSON array
+function summaryJson() {
+    counts=$(countGreenJobs "$metalBlocking" | sed 's/^/blocking /'; countGreenJobs "$metalInforming" | sed 's/^/informing /'; countGreenJobs "$metalUpgrades" | sed 's/^/upgrade /')
+    accepted=$(for v in $(echo "$counts" | awk '{ print $2 }' | sort -uV); do echo "$v $(lastAccepted $v)"; done)
+    jq -n --arg counts "$counts" --arg accepted "$accepted" --argjson stale $STALE_PAYLOAD_HOURS '
+        ($accepted | split("\n") | map(select(. != "") | split(" ") | {key: .[0], value: (if .[1] then {payload: .[1], age_hours: (.[2] // null | tonumber?), stale: ((.[2] // "0" | tonumber) > $stale)} else null end)}) | from_entries) as $acc
+        | $counts | split("\n") | map(select(. != "") | split(" ")) | group_by(.[1])
+        | map({version: .[0][1]} + (map({key: .[0], value: {green: (.[2] | tonumber), total: (.[3] | tonumber)}}) | from_entries) + {last_accepted: $acc[.[0][1]]})
+        | sort_by(.version | split(".") | map(tonumber))'
+}
+
+# Lists the metal-ipi builds still running, with their elapsed time
+function showRunningBuilds() {
+    runningFmt="%-6s%-50s%-23s%-13s%b\n"
+
+    echo
+    printf "$runningFmt" "VER" "RUNNING JOB" "STARTED" "RUNNING FOR" "LINKS"
+    # Only the jobs verifying the selected stream are shown
+    names=$(printf '%s\n' $metalBlocking $metalInforming $metalUpgrades | jq -R . | jq -s .)
+    jq --arg nf $filter --argjson names "$names" -r '.[] | select(.job|test($nf)) | select(.job | IN($names[])) | select((.type=="periodic") and (.state=="pending")) | "\(.job) \(.started) \(.url)"' $PROW_JOBS | sort | while read jobName started url; do
+        version=$(echo ${jobName} | sed -E 's/.[^[[:digit:]]*]*-([[:digit:]]\.[[:digit:]]+)-.*/\1/')
+        jobDisplayName=$(echo ${jobName} | sed -E 's/.[^[[:digit:]]*]*-[[:digit:]]\.[[:digit:]]+-(.*)/\1/')
+        elapsed=$(( $(date --utc +%s) - started ))
+        printf "$runningFmt" "$version" "$jobDisplayName" "$(date --utc -d @$started +%Y-%m-%dT%H:%M:%SZ)" "$((elapsed / 3600))h$((elapsed % 3600 / 60))m" "$(hyperlink $url dashboard)"
+    done
+}
+
+# Writes the failed jobs listed by collectResultsFor to the given file,
+# as a Markdown table or as CSV according to its extension
+function exportResults() {
+    case $2 in
+      *.md)
+        {
+            echo "| Version | Type | Job | Started | Failure reason | Last 10 | Links |"
+            echo "|---|---|---|---|---|---|---|"
+            echo -n "$1" | jq -R -r 'split("\t") | "| \(.[0]) | \(.[1])\(if .[2] == "true" then "*" else "" end) | \(.[3] | sub("^.*?-[0-9]+\\.[0-9]+-"; "")) | \(.[5]) | \(.[6]) | \(.[7]) | [dashboard](\(.[8])) [artifacts](\(.[9])) [sippy](\(.[10])) |"'
+            echo
+            echo "(*) aggregated job"
+        } > "$2"
+        ;;
+      *.csv)
+        {
+            echo "version,type,aggregated,job,build_id,started,reason,last_builds,dashboard,artifacts,sippy"
+            echo -n "$1" | jq -R -r 'split("\t") | @csv'
+        } > "$2"
+        ;;
+    esac
+    echo "Failed jobs exported to $2" >&2
+}
+
+# Prints the metal-ipi builds still running as a JSON array
+function runningJson() {
+    names=$(printf '%s\n' $metalBlocking $metalInforming $metalUpgrades | jq -R . | jq -s .)
+    jq --arg nf $filter --argjson names "$names" '[ .[] | select(.job|test($nf)) | select(.job | IN($names[])) | select((.type=="periodic") and (.state=="pending")) | {version: (.job | capture("-(?<v>[0-9]+\\.[0-9]+)-").v), job: .job, build_id: .build_id, started: (.started | tonumber | todateiso8601), url: .url} ] | sort_by(.job)' $PROW_JOBS
+}
+
+results=$(collectResultsFor "$metalInforming" "Informing"; collectResultsFor "$metalUpgrades" "Upgrade"; collectResultsFor "$metalBlocking" "Blocking")
+if [ -n "$results" ]; then
+    results="$results"$'\n'
+fi
+if [ -n "$EXPORT_FILE" ]; then
+    exportResults "$results" "$EXPORT_FILE"
+fi
+
+if [ "$OUTPUT" = "json" ]; then
+    jq -n --argjson summary "$(summaryJson)" --argjson failures "$(resultsJson "$results")" --argjson running "$(runningJson)" '{summary: $summary, failures: $failures, running: $running}'
+    exit 0
+fi
+
+showSummary
+printf "$fmt" "VER" "TYPE" "JOB" "STARTED" "FAILURE REASON" "LAST 10   " "LINKS"
+showResults "$results"
+echo "(*) aggregated job"
+showRunningBuilds
 echo "metal-ipi-releases.sh finished on $(date) ($(date --utc))"
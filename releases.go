@@ -0,0 +1,65 @@
+// Package releases analyzes the builds of the metal-ipi Prow jobs, to find
+// the tests failing intermittently. It's the library the
+// check-intermittent-failures command is built on, e.g.
+//
+//	opts := releases.DefaultOptions(releases.DefaultCacheDir())
+//	name, _ := releases.JobName("nightly", "4.10", "e2e-metal-ipi")
+//	if job := releases.AnalyzeJob(ctx, name, opts); job != nil {
+//		err = releases.WriteFlakeRecords(os.Stdout, "json", job.FlakeRecords())
+//	}
+package releases
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andfasano/metal-ipi-releases/internal/flakes"
+	"github.com/andfasano/metal-ipi-releases/internal/gcs"
+	"github.com/andfasano/metal-ipi-releases/internal/release"
+)
+
+type (
+	// Options tells how the jobs builds are analyzed and reported
+	Options = flakes.Options
+	// Job is an analyzed Prow job, and the history of its builds
+	Job = flakes.Job
+	// FlakeRecord is a flaky test in the machine readable reports
+	FlakeRecord = flakes.FlakeRecord
+	// Client downloads the builds artifacts, caching them on disk
+	Client = gcs.Client
+)
+
+// DefaultOptions returns the options used when not set otherwise, storing
+// all the cached data and the analysis results in the given folder
+func DefaultOptions(cacheDir string) *Options {
+	return flakes.DefaultOptions(cacheDir)
+}
+
+// DefaultCacheDir returns the platform cache folder for the tool
+func DefaultCacheDir() string {
+	return gcs.DefaultCacheDir()
+}
+
+// JobName returns the name of the metal-ipi job running the given test
+// on a version of the release stream, i.e. nightly, ci, arm64, multi or ppc64le
+func JobName(stream string, version string, test string) (string, error) {
+	rs, ok := release.Streams[stream]
+	if !ok {
+		return "", fmt.Errorf("unsupported release stream %s, expected one of %s", stream, strings.Join(release.StreamNames(), ", "))
+	}
+	return rs.JobName(version, test), nil
+}
+
+// AnalyzeJob updates the saved analysis of the given job with its newest
+// builds. No job is returned when there is nothing to report, or when
+// ctx is cancelled
+func AnalyzeJob(ctx context.Context, name string, opts *Options) *Job {
+	return flakes.Analyze(ctx, name, opts)
+}
+
+// WriteFlakeRecords prints the given flaky tests either as json or as csv
+func WriteFlakeRecords(w io.Writer, format string, records []FlakeRecord) error {
+	return flakes.WriteFlakeRecords(w, format, records)
+}
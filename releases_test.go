@@ -0,0 +1,38 @@
+package releases
+
+import (
+	"testing"
+)
+
+func TestJobName(t *testing.T) {
+	tests := []struct {
+		stream   string
+		expected string
+		err      bool
+	}{
+		{
+			stream:   "nightly",
+			expected: "periodic-ci-openshift-release-master-nightly-4.10-e2e-metal-ipi",
+		},
+		{
+			stream:   "arm64",
+			expected: "periodic-ci-openshift-release-master-nightly-4.10-e2e-metal-ipi-arm64",
+		},
+		{
+			stream: "stable",
+			err:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.stream, func(t *testing.T) {
+			got, err := JobName(tt.stream, "4.10", "e2e-metal-ipi")
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error %t, got %v", tt.err, err)
+			}
+			if got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}